@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+)
+
+// CaptionData is what caption templates of channels are executed with
+type CaptionData struct {
+	ID         string
+	Author     string
+	AuthorName string
+	URL        string
+	Time       time.Time // Zero if the site gives no post time
+	Site       string
+	Tags       []string
+	Text       string // Caption given by the fetcher
+}
+
+// Users can't always type a newline in a command, so \n is accepted for it
+var captionEscapes = strings.NewReplacer(`\n`, "\n", `\t`, "\t")
+
+func parseCaptionTemplate(text string) (*template.Template, error) {
+	return template.New("caption").Parse(text)
+}
+
+func executeCaptionTemplate(tpl *template.Template, data CaptionData) (string, error) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func captionData(moduleId int, message f.ReplyMessage) CaptionData {
+	data := CaptionData{
+		ID:         message.ID,
+		Author:     message.Author,
+		AuthorName: message.AuthorName,
+		URL:        message.URL,
+		Site:       message.Site,
+		Tags:       message.Tags,
+		Text:       message.Caption,
+	}
+	if data.Site == "" {
+		data.Site = MakeModuleLabeler().Module2Str(moduleId)
+	}
+	if message.Time != 0 {
+		data.Time = time.Unix(message.Time, 0)
+	}
+	return data
+}
+
+// escapeCaptionData makes the data safe to render as Telegram HTML, with markup as the text
+func escapeCaptionData(data CaptionData, markup string) CaptionData {
+	data.ID = f.EscapeHTML(data.ID)
+	data.Author = f.EscapeHTML(data.Author)
+	data.AuthorName = f.EscapeHTML(data.AuthorName)
+	data.URL = f.EscapeHTML(data.URL)
+	data.Site = f.EscapeHTML(data.Site)
+	tags := make([]string, 0, len(data.Tags))
+	for _, tag := range data.Tags {
+		tags = append(tags, f.EscapeHTML(tag))
+	}
+	data.Tags = tags
+	data.Text = markup
+	return data
+}
+
+// sampleCaptionData is used to check and preview a template before it is saved
+func sampleCaptionData(site string) CaptionData {
+	return CaptionData{
+		ID:         "1",
+		Author:     "example_user",
+		AuthorName: "Example User",
+		URL:        "https://example.com/example_user/posts/1",
+		Time:       time.Now(),
+		Site:       site,
+		Tags:       []string{"example", "hello"},
+		Text:       "Hello, world!",
+	}
+}
+
+// previewCaptionTemplate validates the template and renders it with sample data
+func previewCaptionTemplate(text string, site string) (string, error) {
+	tpl, err := parseCaptionTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	return executeCaptionTemplate(tpl, sampleCaptionData(site))
+}
+
+// renderCaption applies the caption template of the channel, the fetcher caption is kept on failure
+func (c *Channel) renderCaption(moduleId int, message f.ReplyMessage) f.ReplyMessage {
+	if c.CaptionTemplate == "" {
+		return message
+	}
+	tpl, err := parseCaptionTemplate(c.CaptionTemplate)
+	if err != nil {
+		log.Println("Unable to parse caption template of", c.ID, err)
+		return message
+	}
+	data := captionData(moduleId, message)
+	caption, err := executeCaptionTemplate(tpl, data)
+	if err != nil {
+		log.Println("Unable to render caption template of", c.ID, err)
+		return message
+	}
+	// Text messages can't be empty
+	if caption == "" && len(message.Resources) == 0 {
+		return message
+	}
+	if message.CaptionHTML != "" {
+		// Literal text of the template is taken as markup, the plain caption is the fallback anyway
+		message.CaptionHTML, err = executeCaptionTemplate(tpl, escapeCaptionData(data, message.CaptionHTML))
+		if err != nil {
+			message.CaptionHTML = ""
+		}
+	}
+	message.Caption = caption
+	return message
+}
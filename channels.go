@@ -2,24 +2,21 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/asdine/storm"
 	f "github.com/deamwork/tg_channel_bot/fetchers"
 	"github.com/ihciah/telebot"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
-	MTwitter = iota
-	MTumblr
-	MV2EX
-)
-
-const (
-	DefaultInterval         = 600
-	DefaultMessageQueueSize = 6000
+	DefaultInterval = 600
 )
 
 const (
@@ -35,6 +32,12 @@ const (
 	ChannelActionAddFollow
 	ChannelActionDelFollow
 	ChannelActionUpdatePushInterval
+	ChannelActionSetCaptionTemplate
+	ChannelActionMute
+	ChannelActionSetButtons
+	ChannelActionAddFilter
+	ChannelActionDelFilter
+	ChannelActionSetSyncWindow
 )
 
 type ModuleUser struct {
@@ -47,12 +50,23 @@ type ModuleInterval struct {
 	PushInterval int
 }
 
+type AccountMute struct {
+	Module int
+	Author string
+	Until  int64
+}
+
 type ChannelSetting struct {
-	ID            string `storm:"id"`
-	Enabled       bool   `storm:"index"`
-	AdminUserIDs  *[]string
-	Followings    *map[int][]string
-	PushIntervals *map[int]int
+	ID              string `storm:"id"`
+	Enabled         bool   `storm:"index"`
+	AdminUserIDs    *[]string
+	Followings      *map[int][]string
+	PushIntervals   *map[int]int
+	CaptionTemplate string            // text/template executed with CaptionData, empty for the caption of fetcher
+	Mutes           *map[string]int64 // Muted authors and when the mutes end
+	PostButtons     string            // Buttons under posts, empty for ButtonsAll
+	Filters         *[]FilterRule
+	SyncWindow      int // Seconds to keep posts in sync with their sources, 0 to disable
 }
 
 type ModuleLabeler struct {
@@ -73,15 +87,26 @@ func (M *ModuleLabeler) Module2Str(i int) string {
 	return v
 }
 
-func MakeModuleLabeler() *ModuleLabeler {
-	m2s := map[int]string{
-		MTwitter: "twitter",
-		MTumblr:  "tumblr",
-		MV2EX:    "v2ex",
+func (M *ModuleLabeler) Names() []string {
+	ids := make([]int, 0, len(M.M2s))
+	for id := range M.M2s {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, M.M2s[id])
 	}
-	s2m := make(map[string]int, len(m2s))
-	for k, v := range m2s {
-		s2m[v] = k
+	return names
+}
+
+func MakeModuleLabeler() *ModuleLabeler {
+	modules := f.Modules()
+	m2s := make(map[int]string, len(modules))
+	s2m := make(map[string]int, len(modules))
+	for _, m := range modules {
+		m2s[m.ID] = m.Name
+		s2m[m.Name] = m.ID
 	}
 	m := ModuleLabeler{M2s: m2s, S2m: s2m}
 	return &m
@@ -91,6 +116,10 @@ func (cset *ChannelSetting) update(action int, param interface{}) {
 	pint, iok := param.(ModuleInterval)
 	puser, uok := param.(ModuleUser)
 	newAdmin, aok := param.(string)
+	text, tok := param.(string)
+	pmute, mok := param.(AccountMute)
+	prule, rok := param.(FilterRule)
+	pindex, nok := param.(int)
 
 	switch action {
 	case ChannelActionEnable:
@@ -142,6 +171,44 @@ func (cset *ChannelSetting) update(action int, param interface{}) {
 		if iok {
 			(*cset.PushIntervals)[pint.Module] = pint.PushInterval
 		}
+	case ChannelActionSetCaptionTemplate:
+		if tok {
+			cset.CaptionTemplate = text
+		}
+	case ChannelActionMute:
+		if mok {
+			if cset.Mutes == nil {
+				mutes := make(map[string]int64)
+				cset.Mutes = &mutes
+			}
+			now := time.Now().Unix()
+			for key, until := range *cset.Mutes {
+				if until <= now {
+					delete(*cset.Mutes, key)
+				}
+			}
+			(*cset.Mutes)[muteKey(pmute.Module, pmute.Author)] = pmute.Until
+		}
+	case ChannelActionSetButtons:
+		if tok {
+			cset.PostButtons = text
+		}
+	case ChannelActionAddFilter:
+		if rok {
+			if cset.Filters == nil {
+				filters := make([]FilterRule, 0, 1)
+				cset.Filters = &filters
+			}
+			*cset.Filters = append(*cset.Filters, prule)
+		}
+	case ChannelActionDelFilter:
+		if nok && cset.Filters != nil && pindex >= 0 && pindex < len(*cset.Filters) {
+			*cset.Filters = append((*cset.Filters)[:pindex], (*cset.Filters)[pindex+1:]...)
+		}
+	case ChannelActionSetSyncWindow:
+		if nok {
+			cset.SyncWindow = pindex
+		}
 	case ChannelActionAddAdmin:
 		if aok {
 			for _, admin := range *cset.AdminUserIDs {
@@ -171,10 +238,15 @@ type Channel struct {
 	PushControl    chan int
 	Chat           *telebot.Chat
 	MessageControl chan int
-	MessageList    chan f.ReplyMessage
+	Outbox         storm.Node
+	OutboxSignal   chan struct{}
+	DeadLetter     storm.Node
+	lock           sync.RWMutex // Settings are changed by handlers while the channel is running
 }
 
 func (c *Channel) UpdateSettings(action int, param interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.update(action, param)
 	_ = c.DB.Save(c.ChannelSetting)
 }
@@ -191,9 +263,7 @@ func (c *Channel) PushModule(control chan int, moduleId int, followings []string
 					log.Println("Panic!", err)
 				}
 			}()
-			for _, m := range fetcher.GetPush(c.ID, followings) {
-				c.MessageList <- m
-			}
+			c.Enqueue(moduleId, c.applyFilters(moduleId, fetcher.GetPush(c.ID, followings)))
 		}()
 		select {
 		case <-control:
@@ -206,23 +276,64 @@ func (c *Channel) PushModule(control chan int, moduleId int, followings []string
 	}
 }
 
+// WaitSend delivers the outbox in order, pacing is left to the send scheduler of the bot
 func (c *Channel) WaitSend() {
 	for {
-		timeLimit := time.After(time.Duration(3) * time.Second)
-		msg := <-c.MessageList
+		pending := c.PeekOutbox(1)
+		if len(pending) == 0 {
+			select {
+			case <-c.MessageControl:
+				return
+			case <-c.OutboxSignal:
+				continue
+			}
+		}
+		if wait := time.Until(time.Unix(pending[0].NextAttempt, 0)); wait > 0 {
+			select {
+			case <-c.MessageControl:
+				return
+			case <-time.After(wait):
+				continue
+			}
+		}
 		func() {
 			defer func() {
 				if err := recover(); err != nil {
+					// Sending the entry again would panic again
 					log.Println("Panic!", err)
+					pending[0].LastError = fmt.Sprint(err)
+					c.killOutbox(pending[0])
 				}
 			}()
-			_ = c.TgBot.Send(c.Chat, msg)
+			c.lock.RLock()
+			muted := c.isMuted(pending[0].Module, pending[0].Message.Author)
+			message := c.renderCaption(pending[0].Module, pending[0].Message)
+			c.lock.RUnlock()
+			if muted {
+				log.Printf("Message #%d for %s dropped, %s is muted.", pending[0].ID, c.ID, pending[0].Message.Author)
+				c.AckOutbox(pending[0])
+				return
+			}
+			post, keyboard := c.preparePost(pending[0].Module, pending[0].Message)
+			sent, done, err := c.TgBot.Deliver(c.Chat, pending[0].Module, message, keyboard, pending[0].SentParts)
+			sent = append(pending[0].SentIDs, sent...)
+			if err != nil {
+				c.dropPost(post)
+				pending[0].SentParts, pending[0].SentIDs = done, sent
+				c.deliverFailed(pending[0], err)
+				return
+			}
+			if post != nil {
+				post.KeyboardMessage = keyboardMessage(message, keyboard)
+			}
+			c.sentPost(post, sent)
+			c.AckOutbox(pending[0])
 		}()
 
 		select {
 		case <-c.MessageControl:
 			return
-		case <-timeLimit:
+		default:
 			continue
 		}
 	}
@@ -231,6 +342,7 @@ func (c *Channel) WaitSend() {
 func (c *Channel) Push() {
 	go c.WaitSend()
 	for {
+		c.lock.RLock()
 		controllers := make([]chan int, 0, len(*c.Followings))
 		for moduleId, followings := range *c.Followings {
 			signal := make(chan int, 1)
@@ -238,10 +350,18 @@ func (c *Channel) Push() {
 			if len(followings) == 0 {
 				log.Printf("Module %d started but there's no followings.", moduleId)
 			} else {
+				// Followings are changed in place by handlers
+				followings = append([]string{}, followings...)
 				go c.PushModule(signal, moduleId, followings, time.Duration((*c.PushIntervals)[moduleId])*time.Second)
 				log.Printf("Module %d started:%s.", moduleId, strings.Join(followings, ","))
 			}
 		}
+		if c.SyncWindow > 0 {
+			signal := make(chan int, 1)
+			controllers = append(controllers, signal)
+			go c.SyncPosts(signal)
+		}
+		c.lock.RUnlock()
 		select {
 		case t := <-c.PushControl:
 			log.Printf("Receive signal %d.", t)
@@ -299,6 +419,40 @@ func (c *Channel) UpdateInterval(interval ModuleInterval) {
 	c.Reload()
 }
 
+func (c *Channel) SetCaptionTemplate(text string) {
+	c.UpdateSettings(ChannelActionSetCaptionTemplate, text)
+}
+
+func (c *Channel) Mute(mute AccountMute) {
+	c.UpdateSettings(ChannelActionMute, mute)
+}
+
+func (c *Channel) SetButtons(buttons string) {
+	c.UpdateSettings(ChannelActionSetButtons, buttons)
+}
+
+func (c *Channel) AddFilter(rule FilterRule) {
+	c.UpdateSettings(ChannelActionAddFilter, rule)
+}
+
+// DelFilter removes the filter at index and returns it, the index is checked under the lock
+func (c *Channel) DelFilter(index int) (FilterRule, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Filters == nil || index < 0 || index >= len(*c.Filters) {
+		return FilterRule{}, false
+	}
+	rule := (*c.Filters)[index]
+	c.update(ChannelActionDelFilter, index)
+	_ = c.DB.Save(c.ChannelSetting)
+	return rule, true
+}
+
+func (c *Channel) SetSyncWindow(window int) {
+	c.UpdateSettings(ChannelActionSetSyncWindow, window)
+	c.Reload()
+}
+
 func MakeChannels(telegramBot *TelegramBot) []*Channel {
 	db := telegramBot.Database
 	var channelSettings []ChannelSetting
@@ -316,8 +470,10 @@ func MakeChannels(telegramBot *TelegramBot) []*Channel {
 			log.Printf("Chat %s deleted.\n", channelSettings[i].ID)
 			continue
 		}
-		channels = append(channels, &Channel{&channelSettings[i], db, telegramBot, make(chan int),
-			chat, make(chan int), make(chan f.ReplyMessage, DefaultMessageQueueSize)})
+		channels = append(channels, &Channel{ChannelSetting: &channelSettings[i], DB: db, TgBot: telegramBot,
+			PushControl: make(chan int), Chat: chat, MessageControl: make(chan int),
+			Outbox: outboxOf(db, channelSettings[i].ID), OutboxSignal: make(chan struct{}, 1),
+			DeadLetter: deadLetterOf(db, channelSettings[i].ID)})
 	}
 	return channels
 }
@@ -364,8 +520,9 @@ func AddChannelIfNotExists(telegramBot *TelegramBot, channelId string) (*Channel
 	log.Println("Channel added.")
 	_ = tx.Commit()
 
-	return &Channel{&channelSetting, db, telegramBot, make(chan int), chat,
-		make(chan int), make(chan f.ReplyMessage, DefaultMessageQueueSize)}, nil
+	return &Channel{ChannelSetting: &channelSetting, DB: db, TgBot: telegramBot, PushControl: make(chan int),
+		Chat: chat, MessageControl: make(chan int), Outbox: outboxOf(db, channelId),
+		OutboxSignal: make(chan struct{}, 1), DeadLetter: deadLetterOf(db, channelId)}, nil
 }
 
 func DelChannelIfExists(telegramBot *TelegramBot, channelId string) error {
@@ -376,6 +533,11 @@ func DelChannelIfExists(telegramBot *TelegramBot, channelId string) error {
 		log.Println("Error when delete channel.", err)
 		return err
 	}
+	for _, bucket := range []string{"outbox", "deadletter"} {
+		if err := db.From(bucket).Drop(channelId); err != nil && err != bolt.ErrBucketNotFound {
+			log.Printf("Error when delete %s of channel. %s", bucket, err)
+		}
+	}
 
 	return nil
 }
@@ -383,6 +545,7 @@ func DelChannelIfExists(telegramBot *TelegramBot, channelId string) error {
 func RunPusher(telegramBot *TelegramBot) {
 	channels := MakeChannels(telegramBot)
 	telegramBot.Channels = &channels
+	go PrunePosts(telegramBot.Database)
 
 	for _, c := range channels {
 		go c.Push()
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	MaxSendAttempts = 5
+	RetryBaseDelay  = 5 * time.Second
+	RetryMaxDelay   = 30 * time.Minute
+)
+
+var retryAfterRegex = regexp.MustCompile(`retry after (\d+)`)
+
+// Errors which are worth retrying, everything else is treated as permanent
+var transientErrors = []string{
+	// Network and system failures reported by telebot
+	"http.Post failed",
+	"system error",
+	"bad response json",
+	// Telegram side failures
+	"Too Many Requests",
+	"internal server error",
+	"Internal Server Error",
+	"Bad Gateway",
+	"Gateway Timeout",
+	"Service Unavailable",
+}
+
+// classifySendError tells whether a failed send may succeed later, and how long Telegram asks us to wait
+func classifySendError(err error) (transient bool, retryAfter time.Duration) {
+	msg := err.Error()
+	if match := retryAfterRegex.FindStringSubmatch(msg); match != nil {
+		seconds, _ := strconv.Atoi(match[1])
+		return true, time.Duration(seconds) * time.Second
+	}
+	for _, e := range transientErrors {
+		if strings.Contains(msg, e) {
+			return true, 0
+		}
+	}
+	// Telegram rejected the message itself, e.g. bad request or forbidden
+	return false, 0
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < attempts && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	return delay
+}
+
+func deadLetterOf(db *storm.DB, channelId string) storm.Node {
+	return db.From("deadletter", channelId)
+}
+
+// deliverFailed schedules a retry of the entry, or moves it to the dead-letter bucket
+func (c *Channel) deliverFailed(entry OutboxEntry, err error) {
+	transient, retryAfter := classifySendError(err)
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if !transient || entry.Attempts >= MaxSendAttempts {
+		log.Printf("Message #%d for %s failed %d time(s), moved to dead-letter. %s", entry.ID, c.ID, entry.Attempts, err)
+		c.killOutbox(entry)
+		return
+	}
+	delay := retryDelay(entry.Attempts)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	entry.NextAttempt = time.Now().Add(delay).Unix()
+	log.Printf("Message #%d for %s failed, retry in %s. %s", entry.ID, c.ID, delay, err)
+	if err := c.Outbox.Update(&entry); err != nil {
+		log.Println("Unable to update outbox", err)
+	}
+}
+
+func (c *Channel) killOutbox(entry OutboxEntry) {
+	if err := c.DeadLetter.Save(&entry); err != nil {
+		log.Println("Unable to save dead-letter", err)
+		return
+	}
+	c.AckOutbox(entry)
+}
+
+func (c *Channel) ListDeadLetter() []OutboxEntry {
+	var entries []OutboxEntry
+	if err := c.DeadLetter.All(&entries); err != nil {
+		log.Println("Unable to read dead-letter", err)
+		return []OutboxEntry{}
+	}
+	return entries
+}
+
+// Resend moves dead-letter entries back to the tail of the outbox
+func (c *Channel) Resend(entries []OutboxEntry) int {
+	resent := 0
+	for _, entry := range entries {
+		revived := entry
+		revived.ID, revived.Attempts, revived.NextAttempt = 0, 0, 0
+		if err := c.Outbox.Save(&revived); err != nil {
+			log.Println("Unable to save message to outbox", err)
+			continue
+		}
+		if err := c.DeadLetter.DeleteStruct(&entry); err != nil {
+			log.Println("Unable to remove dead-letter", err)
+		}
+		resent++
+	}
+	select {
+	case c.OutboxSignal <- struct{}{}:
+	default:
+	}
+	return resent
+}
+
+func (c *Channel) PurgeDeadLetter() error {
+	err := c.DeadLetter.Drop(&OutboxEntry{})
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
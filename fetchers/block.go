@@ -0,0 +1,75 @@
+package fetchers
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Kinds of things which can be blocked for a channel
+const (
+	BlockItem   = "item"
+	BlockMedia  = "media"
+	BlockAuthor = "author"
+)
+
+// mediaKey identifies a media by the host and path of its URL, file names alone like
+// image.jpg collide across sites. Values which are not URLs are keys already.
+func mediaKey(media string) string {
+	u, err := url.Parse(media)
+	if err != nil || u.Host == "" {
+		return media
+	}
+	return strings.ToLower(u.Host) + u.Path
+}
+
+func blockKey(channelId, kind, value string) string {
+	switch kind {
+	case BlockMedia:
+		// Same as the keys of Tumblr images blocked by older versions
+		return fmt.Sprintf("%s@%s", channelId, mediaKey(value))
+	case BlockAuthor:
+		value = strings.ToLower(value)
+	}
+	return fmt.Sprintf("%s@%s:%s", channelId, kind, value)
+}
+
+// Block stops pushing an item id, a media or an author to the channel
+func (f *BaseFetcher) Block(kind string, value string) string {
+	if f.DB == nil {
+		return "Unsupported site."
+	}
+	switch kind {
+	case BlockItem, BlockMedia, BlockAuthor:
+	default:
+		return fmt.Sprintf("Unknown block kind %s.", kind)
+	}
+	if value == "" {
+		return fmt.Sprintf("No %s to block.", kind)
+	}
+	if err := f.DB.Set("block", blockKey(f.channelId, kind, value), true); err != nil {
+		return fmt.Sprintf("Unable to block %s %s. %s", kind, value, err)
+	}
+	return fmt.Sprintf("%s %s blocked.", kind, value)
+}
+
+// dropBlocked removes the blocked media from resources
+func (f *BaseFetcher) dropBlocked(resources []Resource) []Resource {
+	ret := make([]Resource, 0, len(resources))
+	for _, r := range resources {
+		if !f.Blocked(BlockMedia, r.URL) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// Blocked reports whether the item id, media or author is blocked for the channel
+func (f *BaseFetcher) Blocked(kind string, value string) bool {
+	if f.DB == nil || value == "" {
+		return false
+	}
+	blocked := false
+	err := f.DB.Get("block", blockKey(f.channelId, kind, value), &blocked)
+	return err == nil && blocked
+}
@@ -0,0 +1,59 @@
+package fetchers
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// SeenItem remembers an item pushed to a channel, to avoid pushing it again
+type SeenItem struct {
+	Key  string `storm:"id"`    // channel@item
+	Seen int64  `storm:"index"` // Unix time the item was last fetched
+}
+
+var (
+	pruneLock sync.Mutex
+	lastPrune = make(map[string]time.Time)
+)
+
+// initStore points the fetcher to its bucket and the dedup store inside it
+func (f *BaseFetcher) initStore(db *storm.DB, site string) {
+	f.DB = db.From(site)
+	f.seen = f.DB.From("dedup")
+
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+	if time.Since(lastPrune[site]) < cachePurge*time.Hour {
+		return
+	}
+	lastPrune[site] = time.Now()
+	go f.pruneSeen()
+}
+
+func (f *BaseFetcher) pruneSeen() {
+	expired := time.Now().Add(-cacheExp * time.Hour).Unix()
+	err := f.seen.Select(q.Lt("Seen", expired)).Delete(new(SeenItem))
+	if err != nil && err != storm.ErrNotFound {
+		log.Println("Unable to prune dedup store", err)
+	}
+}
+
+// Seen reports whether the item has been pushed to the channel, and marks it as pushed.
+// The mark is renewed each time, so items still listed by their source never expire.
+// Everything is new in a dry run, and nothing is marked.
+func (f *BaseFetcher) Seen(channelId, itemId string) bool {
+	if f.seen == nil || f.dryRun {
+		return false
+	}
+	key := fmt.Sprintf("%s@%s", channelId, itemId)
+	now := time.Now()
+	var item SeenItem
+	seen := f.seen.One("Key", key, &item) == nil && now.Sub(time.Unix(item.Seen, 0)) < cacheExp*time.Hour
+	_ = f.seen.Save(&SeenItem{Key: key, Seen: now.Unix()})
+	return seen
+}
@@ -21,7 +21,7 @@ func (f *ExampleFetcher) GetPush(string, []string) []ReplyMessage {
 		return []ReplyMessage{{Err: err}}
 	}
 	log.Println("Image url get", imgUrl)
-	reply := ReplyMessage{[]Resource{{URL: imgUrl, T: TIMAGE}}, "", nil}
+	reply := ReplyMessage{Resources: []Resource{{URL: imgUrl, T: TIMAGE}}}
 	return []ReplyMessage{reply}
 }
 
@@ -2,9 +2,12 @@ package fetchers
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/asdine/storm"
@@ -14,6 +17,8 @@ import (
 const (
 	TIMAGE = iota
 	TVIDEO
+	TDOCUMENT
+	TAUDIO
 )
 
 const (
@@ -21,36 +26,70 @@ const (
 	cachePurge = 336
 )
 
+const (
+	DefaultUA       = "Mozilla/5.0 (Windows NT 6.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0.2228.0 Safari/537.36"
+	DownloadTimeout = 5 * time.Minute
+)
+
 type Resource struct {
-	URL     string
-	T       int
-	Caption string
+	URL       string
+	T         int
+	Caption   string
+	Duration  int    // Seconds of a video or audio, 0 if unknown
+	Width     int    // Pixels, 0 if unknown
+	Height    int    // Pixels, 0 if unknown
+	Thumbnail string // URL of a JPEG preview of a video within 320px and 200KB
 }
 
 type ReplyMessage struct {
-	Resources []Resource
-	Caption   string
-	Err       error
+	Resources   []Resource
+	Caption     string
+	CaptionHTML string   // Caption in the HTML subset of Telegram, empty if the site gives no markup
+	ID          string   // Id of the source item on the site
+	Site        string   // Name of the module which fetched the item
+	Author      string   // Handle of who posted the item
+	AuthorName  string   // Display name of who posted the item
+	URL         string   // Permalink of the source item
+	Time        int64    // Unix time the item was posted, 0 if unknown
+	Tags        []string // Tags or hashtags of the item
+	Following   string   // Following of the channel the item was fetched for
+	Retweet     bool     // Shared from another account
+	Reply       bool     // Reply to another item
+	Thread      []string // Ids of replies merged into the item
+	Err         error    `json:"-"`
+}
+
+// Cursor records how far a following of a channel has been pushed
+type Cursor struct {
+	ID   int64 // Newest item id pushed, 0 if unknown
+	Time int64 // Push items newer than this unix time if ID is unknown
 }
 
 type Fetcher interface {
 	Init(*storm.DB, string) error                      // Initializing
 	GetPush(string, []string) []ReplyMessage           // For channel message
 	GetPushAtLeastOne(string, []string) []ReplyMessage // For user message
-	GoBack(string, int64) error                        // Set last update time to N seconds before
-	Block(string) string
+	GoBack(string, []string, int64) error              // Set cursors of followings to N seconds before
+	Block(string, string) string                       // Block an item id, media or author for the channel
+	Download(string, io.Writer, int64) (int64, error)  // Download a resource with the HTTP client of the site
+	Latest(string, int) ([]ReplyMessage, error)        // Newest N items of a following oldest first, cursors and dedup untouched
+	Lookup(string, string) (ReplyMessage, error)       // Current state of an item of a following, ErrItemGone if deleted
+	Configure(string, string, string) string           // Set an option of a following for the channel, show them if no option
 }
 
 type BaseFetcher struct {
-	UA     string
-	DB     storm.Node
-	sling  *sling.Sling
-	client http.Client
+	UA        string
+	DB        storm.Node
+	sling     *sling.Sling
+	client    http.Client
+	seen      storm.Node
+	dryRun    bool   // Don't mark items as seen
+	channelId string // Channel the fetcher works for
 }
 
 // Initialize
 func (f *BaseFetcher) Init(db *storm.DB, _ string) error {
-	f.UA = "Mozilla/5.0 (Windows NT 6.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0.2228.0 Safari/537.36"
+	f.UA = DefaultUA
 	f.client = http.Client{Timeout: time.Duration(30) * time.Second}
 	return nil
 }
@@ -77,6 +116,55 @@ func (f *BaseFetcher) HTTPGet(url string) ([]byte, error) {
 	return respContent, nil
 }
 
+// ErrItemGone is returned by Lookup when the item was deleted from the site
+var ErrItemGone = errors.New("item gone")
+
+// ErrUnsupported is returned by features the site has no support for
+var ErrUnsupported = errors.New("unsupported")
+
+// ErrTooLarge is returned by Download when the resource exceeds the limit
+var ErrTooLarge = errors.New("resource too large")
+
+// Download writes at most limit bytes of the resource to w
+func (f *BaseFetcher) Download(resourceUrl string, w io.Writer, limit int64) (int64, error) {
+	request, err := http.NewRequest("GET", resourceUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	ua := f.UA
+	if ua == "" {
+		ua = DefaultUA
+	}
+	request.Header.Set("User-Agent", ua)
+	// Some media hosts refuse hotlinking without a referer of their own site
+	if u, err := url.Parse(resourceUrl); err == nil {
+		request.Header.Set("Referer", fmt.Sprintf("%s://%s/", u.Scheme, u.Host))
+	}
+	client := f.client
+	if client.Timeout < DownloadTimeout {
+		client.Timeout = DownloadTimeout
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if response.ContentLength > limit {
+		return 0, ErrTooLarge
+	}
+	n, err := io.Copy(w, io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, ErrTooLarge
+	}
+	return n, nil
+}
+
 // For channel update
 func (f *BaseFetcher) GetPush(string, []string) []ReplyMessage {
 	return []ReplyMessage{{Caption: "Unsupported. You should define GetPush function first."}}
@@ -91,11 +179,87 @@ func (f *BaseFetcher) GetPushAtLeastOne(userid string, following []string) (ret
 	return
 }
 
-// Set last update time to several seconds before
-func (f *BaseFetcher) GoBack(string, int64) error {
+// Set cursors of followings to several seconds before
+func (f *BaseFetcher) GoBack(string, []string, int64) error {
 	return errors.New("time machine unsupported for this site")
 }
 
-func (f *BaseFetcher) Block(string) string {
-	return "Unimplement."
+func cursorKey(channelId, following string) string {
+	return fmt.Sprintf("%s@%s", channelId, following)
+}
+
+func (f *BaseFetcher) GetCursor(channelId, following string) Cursor {
+	var cursor Cursor
+	_ = f.DB.Get("cursor", cursorKey(channelId, following), &cursor)
+	return cursor
+}
+
+// migrateCursors turns the last_update timestamp of channels saved before cursors
+// into cursors of the followings they had, followings added later start afresh
+func (f *BaseFetcher) migrateCursors(channelId string, followings []string) {
+	if len(followings) == 0 {
+		return
+	}
+	lastUpdates := make(map[string]int64)
+	var lastUpdate int64
+	if err := f.DB.Get("last_update", channelId, &lastUpdate); err == nil {
+		for _, following := range followings {
+			lastUpdates[following] = lastUpdate
+		}
+	} else if err := f.DB.Get("last_update", channelId, &lastUpdates); err != nil {
+		return
+	}
+	for following, t := range lastUpdates {
+		var cursor Cursor
+		if err := f.DB.Get("cursor", cursorKey(channelId, following), &cursor); err == nil || t == 0 {
+			continue
+		}
+		if err := f.SetCursor(channelId, following, Cursor{Time: t}); err != nil {
+			log.Println("Unable to migrate cursor", err)
+			return
+		}
+	}
+	_ = f.DB.Delete("last_update", channelId)
+}
+
+// FirstPushItems is how many items of a following without cursor are pushed
+const FirstPushItems = 3
+
+// firstPush keeps the newest items of a following fetched without cursor, older ones only
+// move the cursor. Messages are oldest first.
+func firstPush(messages []ReplyMessage) []ReplyMessage {
+	if len(messages) > FirstPushItems {
+		return messages[len(messages)-FirstPushItems:]
+	}
+	return messages
+}
+
+func (f *BaseFetcher) SetCursor(channelId, following string, cursor Cursor) error {
+	return f.DB.Set("cursor", cursorKey(channelId, following), cursor)
+}
+
+// goBackCursors resets cursors of followings to a time based one
+func (f *BaseFetcher) goBackCursors(channelId string, followings []string, back int64) error {
+	now := time.Now().Unix()
+	if back > now {
+		return errors.New("back too long")
+	}
+	for _, following := range followings {
+		if err := f.SetCursor(channelId, following, Cursor{Time: now - back}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *BaseFetcher) Latest(string, int) ([]ReplyMessage, error) {
+	return []ReplyMessage{}, ErrUnsupported
+}
+
+func (f *BaseFetcher) Lookup(string, string) (ReplyMessage, error) {
+	return ReplyMessage{}, ErrUnsupported
+}
+
+func (f *BaseFetcher) Configure(string, string, string) string {
+	return "No option for this site."
 }
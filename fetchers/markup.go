@@ -0,0 +1,219 @@
+package fetchers
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Tags understood by Telegram and what they are sent as
+// ref: https://core.telegram.org/bots/api#html-style
+var telegramTags = map[string]string{
+	"b":      "b",
+	"strong": "b",
+	"i":      "i",
+	"em":     "i",
+	"u":      "u",
+	"ins":    "u",
+	"s":      "s",
+	"strike": "s",
+	"del":    "s",
+	"code":   "code",
+	"pre":    "pre",
+	"a":      "a",
+}
+
+// Tags which start a new line, and the ones which are followed by an empty line
+var (
+	lineTags = map[string]bool{"div": true, "li": true, "tr": true, "figure": true, "figcaption": true,
+		"ul": true, "ol": true, "table": true}
+	paragraphTags = map[string]bool{"p": true, "blockquote": true, "h1": true, "h2": true, "h3": true,
+		"h4": true, "h5": true, "h6": true}
+	// Tags whose content is never shown
+	hiddenTags = map[string]bool{"script": true, "style": true, "noscript": true, "template": true}
+)
+
+var spaceRegex = regexp.MustCompile(`\s+`)
+
+// EscapeHTML escapes text for the HTML parse mode of Telegram
+func EscapeHTML(s string) string {
+	return html.EscapeString(s)
+}
+
+type markupTag struct {
+	tag     string
+	written bool // False if Telegram can't take the tag here, only its text is kept
+}
+
+// markupWriter writes the plain text and the Telegram markup of a document side by side
+type markupWriter struct {
+	text   strings.Builder
+	markup strings.Builder
+	open   []markupTag
+}
+
+func (w *markupWriter) atLineStart() bool {
+	s := w.text.String()
+	return s == "" || strings.HasSuffix(s, "\n")
+}
+
+func (w *markupWriter) write(s string) {
+	w.text.WriteString(s)
+	w.markup.WriteString(EscapeHTML(s))
+}
+
+// newline ends the current line, keeping at most one empty line
+func (w *markupWriter) newline() {
+	if !strings.HasSuffix(w.text.String(), "\n\n") {
+		w.text.WriteString("\n")
+		w.markup.WriteString("\n")
+	}
+}
+
+func (w *markupWriter) breakLine() {
+	if !w.atLineStart() {
+		w.newline()
+	}
+}
+
+func (w *markupWriter) breakParagraph() {
+	w.breakLine()
+	if w.text.Len() != 0 {
+		w.newline()
+	}
+}
+
+func (w *markupWriter) inside(tags ...string) bool {
+	for _, o := range w.open {
+		for _, t := range tags {
+			if o.written && o.tag == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openTag opens the tag, href is empty for tags other than links and unusable links
+func (w *markupWriter) openTag(tag string, href string) {
+	// Telegram doesn't allow entities inside links and code
+	if w.inside("a", "code", "pre") || (tag == "a" && href == "") {
+		w.open = append(w.open, markupTag{tag, false})
+		return
+	}
+	if tag == "a" {
+		w.markup.WriteString(`<a href="` + EscapeHTML(href) + `">`)
+	} else {
+		w.markup.WriteString("<" + tag + ">")
+	}
+	w.open = append(w.open, markupTag{tag, true})
+}
+
+// closeTag closes the last open tag, and tags opened after it to keep the markup nested
+func (w *markupWriter) closeTag(tag string) {
+	for i := len(w.open) - 1; i >= 0; i-- {
+		if w.open[i].tag != tag {
+			continue
+		}
+		w.closeFrom(i)
+		return
+	}
+}
+
+func (w *markupWriter) closeFrom(i int) {
+	for j := len(w.open) - 1; j >= i; j-- {
+		if w.open[j].written {
+			w.markup.WriteString("</" + w.open[j].tag + ">")
+		}
+	}
+	w.open = w.open[:i]
+}
+
+func (w *markupWriter) result() (string, string) {
+	w.closeFrom(0)
+	return strings.TrimSpace(w.text.String()), strings.TrimSpace(w.markup.String())
+}
+
+func linkTarget(token xhtml.Token) string {
+	for _, attr := range token.Attr {
+		if attr.Key == "href" {
+			href := strings.TrimSpace(attr.Val)
+			if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "tg://") {
+				return href
+			}
+		}
+	}
+	return ""
+}
+
+// ConvertHTML turns HTML of a site into plain text and into the HTML subset of Telegram.
+// Unsupported tags are dropped, block elements become line breaks.
+func ConvertHTML(src string) (text string, markup string) {
+	w := &markupWriter{}
+	z := xhtml.NewTokenizer(strings.NewReader(src))
+	hidden := 0 // Depth of hidden tags open
+	for {
+		tokenType := z.Next()
+		var token xhtml.Token
+		if tokenType == xhtml.StartTagToken || tokenType == xhtml.EndTagToken || tokenType == xhtml.SelfClosingTagToken {
+			token = z.Token()
+		}
+		if hiddenTags[token.Data] && tokenType != xhtml.SelfClosingTagToken {
+			if tokenType == xhtml.StartTagToken {
+				hidden++
+			} else if hidden > 0 {
+				hidden--
+			}
+			continue
+		}
+		if hidden > 0 && tokenType != xhtml.ErrorToken {
+			continue
+		}
+		switch tokenType {
+		case xhtml.ErrorToken:
+			return w.result()
+		case xhtml.TextToken:
+			s := string(z.Text())
+			if !w.inside("pre") {
+				s = spaceRegex.ReplaceAllString(s, " ")
+				if w.atLineStart() {
+					s = strings.TrimLeft(s, " ")
+				}
+			}
+			w.write(s)
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			name := token.Data
+			switch {
+			case name == "br":
+				w.newline()
+			case name == "li":
+				w.breakLine()
+				w.write("• ")
+			case lineTags[name]:
+				w.breakLine()
+			case paragraphTags[name]:
+				w.breakParagraph()
+			}
+			if tag, ok := telegramTags[name]; ok && token.Type == xhtml.StartTagToken {
+				href := ""
+				if tag == "a" {
+					href = linkTarget(token)
+				}
+				w.openTag(tag, href)
+			}
+		case xhtml.EndTagToken:
+			tag := token.Data
+			switch {
+			case lineTags[tag]:
+				w.breakLine()
+			case paragraphTags[tag]:
+				w.breakParagraph()
+			}
+			if t, ok := telegramTags[tag]; ok {
+				w.closeTag(t)
+			}
+		}
+	}
+}
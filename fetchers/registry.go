@@ -0,0 +1,88 @@
+package fetchers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Module describes a site which can be followed by channels
+type Module struct {
+	ID     int                                  // Persistent id, stored as key of channel followings
+	Name   string                               // Site name used in commands and as config section
+	New    func() Fetcher                       // Factory of an unconfigured fetcher
+	Decode func(Fetcher, json.RawMessage) error // Config decoder, JSONDecoder if nil
+	Env    map[string]string                    // Environment variable => config key
+}
+
+var modules = make(map[int]*Module)
+
+// Register makes a module available to channels. It should be called in init of the fetcher.
+func Register(m Module) {
+	if _, ok := modules[m.ID]; ok {
+		panic(fmt.Sprintf("fetchers: module id %d registered twice", m.ID))
+	}
+	if _, ok := ModuleByName(m.Name); ok {
+		panic(fmt.Sprintf("fetchers: module %s registered twice", m.Name))
+	}
+	if m.Decode == nil {
+		m.Decode = JSONDecoder
+	}
+	modules[m.ID] = &m
+}
+
+func JSONDecoder(f Fetcher, config json.RawMessage) error {
+	if len(config) == 0 {
+		return nil
+	}
+	return json.Unmarshal(config, f)
+}
+
+// Modules returns all registered modules ordered by id
+func Modules() []*Module {
+	ret := make([]*Module, 0, len(modules))
+	for _, m := range modules {
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+func ModuleByID(id int) (*Module, bool) {
+	m, ok := modules[id]
+	return m, ok
+}
+
+func ModuleByName(name string) (*Module, bool) {
+	for _, m := range modules {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Create builds a new fetcher of the module with given config section
+func (m *Module) Create(config json.RawMessage) (Fetcher, error) {
+	fetcher := m.New()
+	if err := m.Decode(fetcher, config); err != nil {
+		return nil, err
+	}
+	return fetcher, nil
+}
+
+// ConfigFromEnv builds the config section of the module from environment variables.
+// Returns nil if none of the variables is set.
+func (m *Module) ConfigFromEnv(getenv func(string) string) json.RawMessage {
+	config := make(map[string]string, len(m.Env))
+	for env, key := range m.Env {
+		if v := getenv(env); v != "" {
+			config[key] = v
+		}
+	}
+	if len(config) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(config)
+	return data
+}
@@ -0,0 +1,359 @@
+package fetchers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+type RSSFeed struct {
+	Channel struct {
+		Title string    `xml:"title"`
+		Link  string    `xml:"link"`
+		Items []RSSItem `xml:"item"`
+	} `xml:"channel"`
+	Items []RSSItem `xml:"item"` // RSS 1.0 (RDF) puts items next to the channel
+}
+
+type RSSItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+	Content     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Enclosures  []struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+type AtomFeed struct {
+	Title   string      `xml:"title"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomEntry struct {
+	ID        string `xml:"id"`
+	Title     string `xml:"title"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+	Links     []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"link"`
+	Author struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Categories []struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+}
+
+// feedItem is the format independent view of a RSS item or an Atom entry
+type feedItem struct {
+	ID         string
+	Title      string
+	Link       string
+	Author     string
+	Time       int64
+	Content    string
+	Enclosures []Resource
+	Tags       []string
+}
+
+var (
+	imgTagRegex  = regexp.MustCompile(`(?i)<img[^>]+src\s*=\s*["']([^"']+)["']`)
+	feedTimeFmts = []string{time.RFC1123Z, time.RFC1123, time.RFC822Z, time.RFC822, time.RFC3339,
+		"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2006-01-02T15:04:05"}
+)
+
+type RSSFetcher struct {
+	BaseFetcher
+}
+
+func init() {
+	Register(Module{
+		ID:   3,
+		Name: "rss",
+		New:  func() Fetcher { return new(RSSFetcher) },
+	})
+}
+
+func (f *RSSFetcher) Init(db *storm.DB, channelId string) (err error) {
+	_ = f.BaseFetcher.Init(db, channelId)
+	f.initStore(db, "rss")
+	f.channelId = channelId
+	return
+}
+
+func parseFeedTime(s string) int64 {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeFmts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+func enclosureType(mime string) (int, bool) {
+	switch {
+	case strings.HasPrefix(mime, "image/gif"):
+		return TVIDEO, true
+	case strings.HasPrefix(mime, "image/"):
+		return TIMAGE, true
+	case strings.HasPrefix(mime, "video/"):
+		return TVIDEO, true
+	case strings.HasPrefix(mime, "audio/"):
+		return TAUDIO, true
+	case mime != "":
+		return TDOCUMENT, true
+	}
+	return 0, false
+}
+
+func newFeedDecoder(content []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	// Best effort for non UTF-8 feeds, most of them are ASCII compatible
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder
+}
+
+func parseFeed(content []byte) ([]feedItem, error) {
+	decoder := newFeedDecoder(content)
+	var root string
+	for root == "" {
+		token, err := decoder.Token()
+		if err != nil {
+			return []feedItem{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start.Name.Local
+		}
+	}
+
+	switch root {
+	case "rss", "RDF":
+		feed := RSSFeed{}
+		if err := newFeedDecoder(content).Decode(&feed); err != nil {
+			return []feedItem{}, err
+		}
+		items := make([]feedItem, 0, len(feed.Channel.Items)+len(feed.Items))
+		for _, i := range append(feed.Channel.Items, feed.Items...) {
+			item := feedItem{ID: i.GUID, Title: i.Title, Link: i.Link, Author: i.Creator, Time: parseFeedTime(i.PubDate),
+				Content: i.Content, Tags: i.Categories}
+			if item.Author == "" {
+				item.Author = i.Author
+			}
+			if item.Author == "" {
+				item.Author = feed.Channel.Title
+			}
+			if item.Link == "" {
+				item.Link = i.GUID
+			}
+			if item.ID == "" {
+				item.ID = item.Link
+			}
+			if item.Content == "" {
+				item.Content = i.Description
+			}
+			for _, e := range i.Enclosures {
+				if t, ok := enclosureType(e.Type); ok && e.URL != "" {
+					item.Enclosures = append(item.Enclosures, Resource{URL: e.URL, T: t, Caption: e.URL})
+				}
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case "feed":
+		feed := AtomFeed{}
+		if err := newFeedDecoder(content).Decode(&feed); err != nil {
+			return []feedItem{}, err
+		}
+		items := make([]feedItem, 0, len(feed.Entries))
+		for _, e := range feed.Entries {
+			item := feedItem{ID: e.ID, Title: e.Title, Author: e.Author.Name, Time: parseFeedTime(e.Published), Content: e.Content}
+			for _, c := range e.Categories {
+				item.Tags = append(item.Tags, c.Term)
+			}
+			if item.Author == "" {
+				item.Author = feed.Title
+			}
+			if item.Time == 0 {
+				item.Time = parseFeedTime(e.Updated)
+			}
+			if item.Content == "" {
+				item.Content = e.Summary
+			}
+			for _, l := range e.Links {
+				switch l.Rel {
+				case "", "alternate":
+					if item.Link == "" {
+						item.Link = l.Href
+					}
+				case "enclosure":
+					if t, ok := enclosureType(l.Type); ok && l.Href != "" {
+						item.Enclosures = append(item.Enclosures, Resource{URL: l.Href, T: t, Caption: l.Href})
+					}
+				}
+			}
+			if item.Link == "" {
+				item.Link = e.ID
+			}
+			if item.ID == "" {
+				item.ID = item.Link
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return []feedItem{}, fmt.Errorf("unsupported feed format %s", root)
+}
+
+func (f *RSSFetcher) getFeed(feedUrl string, cursor Cursor) ([]ReplyMessage, Cursor, error) {
+	respContent, err := f.HTTPGet(feedUrl)
+	if err != nil {
+		log.Println("Unable to request feed", err)
+		return []ReplyMessage{}, cursor, err
+	}
+	items, err := parseFeed(respContent)
+	if err != nil {
+		log.Println("Unable to parse feed", err)
+		return []ReplyMessage{}, cursor, err
+	}
+
+	// Items carry no ordered id, the cursor tracks the newest publish time instead
+	next := cursor
+	// Undated items are told apart by the links listed last time, which never expire
+	known, listed := f.undatedLinks(feedUrl), make(map[string]bool)
+	ret := make([]ReplyMessage, 0, len(items))
+	// Feeds list newest items first, push them in chronological order
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if item.Time > next.Time {
+			next.Time = item.Time
+		}
+		if cursor.Time != 0 && item.Time != 0 && item.Time <= cursor.Time {
+			continue
+		}
+		if item.Time == 0 {
+			listed[item.Link] = true
+			if known[item.Link] {
+				continue
+			}
+		}
+		if f.Blocked(BlockItem, item.ID) || f.Blocked(BlockAuthor, item.Author) {
+			continue
+		}
+		if f.Seen(f.channelId, item.Link) {
+			continue
+		}
+
+		res := item.Enclosures
+		for _, match := range imgTagRegex.FindAllStringSubmatch(item.Content, -1) {
+			imgUrl := html.UnescapeString(match[1])
+			duplicated := false
+			for _, r := range res {
+				if r.URL == imgUrl {
+					duplicated = true
+					break
+				}
+			}
+			if !duplicated {
+				res = append(res, Resource{URL: imgUrl, T: TIMAGE, Caption: imgUrl})
+			}
+		}
+		res = f.dropBlocked(res)
+		caption := strings.TrimSpace(strings.Join([]string{strings.TrimSpace(item.Title), item.Link}, "\n"))
+		ret = append(ret, ReplyMessage{
+			Resources:  res,
+			Caption:    caption,
+			ID:         item.ID,
+			Site:       "rss",
+			Author:     item.Author,
+			AuthorName: item.Author,
+			URL:        item.Link,
+			Time:       item.Time,
+			Tags:       item.Tags,
+			Following:  feedUrl,
+		})
+	}
+	if len(listed) != 0 || len(known) != 0 {
+		f.setUndatedLinks(feedUrl, listed)
+	}
+	return ret, next, nil
+}
+
+// undatedLinks loads the links of undated items the feed listed last time
+func (f *RSSFetcher) undatedLinks(feedUrl string) map[string]bool {
+	links := make(map[string]bool)
+	if f.DB != nil && !f.dryRun {
+		_ = f.DB.Get("undated", cursorKey(f.channelId, feedUrl), &links)
+	}
+	return links
+}
+
+func (f *RSSFetcher) setUndatedLinks(feedUrl string, links map[string]bool) {
+	if f.DB == nil || f.dryRun {
+		return
+	}
+	if err := f.DB.Set("undated", cursorKey(f.channelId, feedUrl), links); err != nil {
+		log.Println("Unable to save links of feed", err)
+	}
+}
+
+func (f *RSSFetcher) GetPush(userID string, followings []string) []ReplyMessage {
+	f.migrateCursors(userID, followings)
+	ret := make([]ReplyMessage, 0, 0)
+	for _, follow := range followings {
+		cursor := f.GetCursor(userID, follow)
+		// Feeds of undated items keep no cursor, but the links listed
+		first := cursor == (Cursor{}) && len(f.undatedLinks(follow)) == 0
+		single, next, err := f.getFeed(follow, cursor)
+		if err != nil {
+			continue
+		}
+		if first {
+			single = firstPush(single)
+		}
+		ret = append(ret, single...)
+		if next != cursor {
+			_ = f.SetCursor(userID, follow, next)
+		}
+	}
+	return ret
+}
+
+func (f *RSSFetcher) Latest(following string, n int) ([]ReplyMessage, error) {
+	f.dryRun = true
+	defer func() { f.dryRun = false }()
+	ret, _, err := f.getFeed(following, Cursor{})
+	// Items are in chronological order
+	if len(ret) > n {
+		ret = ret[len(ret)-n:]
+	}
+	return ret, err
+}
+
+func (f *RSSFetcher) GoBack(userID string, followings []string, back int64) error {
+	return f.goBackCursors(userID, followings, back)
+}
@@ -5,12 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/asdine/storm"
 	"github.com/dghubble/oauth1"
-	"github.com/patrickmn/go-cache"
 )
 
 type TumblrPosts struct {
@@ -19,68 +19,87 @@ type TumblrPosts struct {
 		Msg    string `json:"msg"`
 	} `json:"meta"`
 	Response struct {
-		Posts []struct {
-			Type               string `json:"type"`
-			BlogName           string `json:"blog_name"`
-			ID                 int64  `json:"id"`
-			PostURL            string `json:"post_url"`
-			Slug               string `json:"slug"`
-			Date               string `json:"date"`
-			Timestamp          int    `json:"timestamp"`
-			State              string `json:"state"`
-			Format             string `json:"format"`
-			ShortURL           string `json:"short_url"`
-			IsBlocksPostFormat bool   `json:"is_blocks_post_format"`
-			SourceURL          string `json:"source_url,omitempty"`
-			SourceTitle        string `json:"source_title,omitempty"`
-			Caption            string `json:"caption,omitempty"`
-			Reblog             struct {
-				Comment  string `json:"comment"`
-				TreeHTML string `json:"tree_html"`
-			} `json:"reblog"`
-			Trail []struct {
-				Post struct {
-					ID interface{} `json:"id"`
-				} `json:"post"`
-				ContentRaw string `json:"content_raw"`
-				Content    string `json:"content"`
-			} `json:"trail"`
-			VideoURL        string `json:"video_url,omitempty"`
-			ThumbnailURL    string `json:"thumbnail_url,omitempty"`
-			ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
-			ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
-			Duration        int    `json:"duration,omitempty"`
-			VideoType       string `json:"video_type,omitempty"`
-			DisplayAvatar   bool   `json:"display_avatar"`
-			PhotosetLayout  string `json:"photoset_layout,omitempty"`
-			Photos          []struct {
-				Caption      string `json:"caption"`
-				OriginalSize struct {
-					URL    string `json:"url"`
-					Width  int    `json:"width"`
-					Height int    `json:"height"`
-				} `json:"original_size"`
-			} `json:"photos,omitempty"`
-			ImagePermalink string `json:"image_permalink,omitempty"`
-			Title          string `json:"title,omitempty"`
-			Body           string `json:"body,omitempty"`
-		} `json:"posts"`
+		Blog struct {
+			Name  string `json:"name"`
+			Title string `json:"title"`
+		} `json:"blog"`
+		Posts []TumblrPost `json:"posts"`
 	} `json:"response"`
 }
 
+type TumblrPost struct {
+	Type               string         `json:"type"`
+	BlogName           string         `json:"blog_name"`
+	ID                 int64          `json:"id"`
+	PostURL            string         `json:"post_url"`
+	Slug               string         `json:"slug"`
+	Date               string         `json:"date"`
+	Timestamp          int            `json:"timestamp"`
+	State              string         `json:"state"`
+	Format             string         `json:"format"`
+	ShortURL           string         `json:"short_url"`
+	IsBlocksPostFormat bool           `json:"is_blocks_post_format"`
+	SourceURL          string         `json:"source_url,omitempty"`
+	SourceTitle        string         `json:"source_title,omitempty"`
+	OriginalType       string         `json:"original_type,omitempty"`
+	Content            []TumblrBlock  `json:"content,omitempty"`
+	Layout             []TumblrLayout `json:"layout,omitempty"`
+	Trail              []TumblrTrail  `json:"trail"`
+	DisplayAvatar      bool           `json:"display_avatar"`
+	Tags               []string       `json:"tags"`
+}
+
+// Types of Tumblr posts
+var tumblrPostTypes = []string{"text", "quote", "link", "answer", "video", "audio", "photo", "chat"}
+
+// TumblrOptions are how posts of a following are pushed to a channel
+type TumblrOptions struct {
+	Types []string // Post types pushed, all if empty
+}
+
+func (o TumblrOptions) String() string {
+	if len(o.Types) == 0 {
+		return "types=all"
+	}
+	return "types=" + strings.Join(o.Types, ",")
+}
+
+func (o TumblrOptions) accepts(postType string) bool {
+	if len(o.Types) == 0 {
+		return true
+	}
+	for _, t := range o.Types {
+		if t == postType {
+			return true
+		}
+	}
+	return false
+}
+
 type TumblrFetcher struct {
 	BaseFetcher
 	OAuthConsumerKey    string `json:"consumer_key"`
 	OAuthConsumerSecret string `json:"consumer_secret"`
 	OAuthToken          string `json:"access_token"`
 	OAuthTokenSecret    string `json:"access_token_secret"`
-	cache               *cache.Cache
-	channelId           string
+}
+
+func init() {
+	Register(Module{
+		ID:   1,
+		Name: "tumblr",
+		New:  func() Fetcher { return new(TumblrFetcher) },
+		Env: map[string]string{
+			"TUMBLR_KEY":          "consumer_key",
+			"TUMBLR_SECRET":       "consumer_secret",
+			"TUMBLR_TOKEN":        "access_token",
+			"TUMBLR_TOKEN_SECRET": "access_token_secret",
+		},
+	})
 }
 
 func (f *TumblrFetcher) Init(db *storm.DB, channelId string) (err error) {
-	f.DB = db.From("tumblr")
-	f.cache = cache.New(cacheExp*time.Hour, cachePurge*time.Hour)
+	f.initStore(db, "tumblr")
 	f.channelId = channelId
 	config := oauth1.NewConfig(f.OAuthConsumerKey, f.OAuthConsumerSecret)
 	token := oauth1.NewToken(f.OAuthToken, f.OAuthTokenSecret)
@@ -88,113 +107,217 @@ func (f *TumblrFetcher) Init(db *storm.DB, channelId string) (err error) {
 	return
 }
 
-func (f *TumblrFetcher) getUserTimeline(user string, time int64) ([]ReplyMessage, error) {
+func (f *TumblrFetcher) options(following string) TumblrOptions {
+	var options TumblrOptions
+	if f.DB != nil {
+		_ = f.DB.Get("options", cursorKey(f.channelId, following), &options)
+	}
+	return options
+}
+
+// Configure sets the post types (all or a comma separated list) pushed of a following
+func (f *TumblrFetcher) Configure(following string, key string, value string) string {
+	if f.DB == nil {
+		return "Unsupported site."
+	}
+	options := f.options(following)
+	switch {
+	case key == "":
+		return fmt.Sprintf("Options of %s: %s", following, options)
+	case key == "types" && value == "all":
+		options.Types = nil
+	case key == "types" && value != "":
+		types := strings.Split(value, ",")
+		for _, t := range types {
+			if !(TumblrOptions{Types: tumblrPostTypes}).accepts(t) {
+				return "Unknown post type " + t + ". Types: all or " + strings.Join(tumblrPostTypes, ",")
+			}
+		}
+		options.Types = types
+	default:
+		return "Options: types=all or " + strings.Join(tumblrPostTypes, ",")
+	}
+	if err := f.DB.Set("options", cursorKey(f.channelId, following), options); err != nil {
+		return fmt.Sprintf("Unable to set option. %s", err)
+	}
+	return fmt.Sprintf("Options of %s: %s", following, options)
+}
+
+func (f *TumblrFetcher) getUserTimeline(user string, cursor Cursor) ([]ReplyMessage, Cursor, error) {
 	if f.OAuthConsumerKey == "" {
-		return []ReplyMessage{}, errors.New("need API key")
+		return []ReplyMessage{}, cursor, errors.New("need API key")
 	}
-	apiUrl := fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/posts", user)
+	apiUrl := fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/posts?npf=true", user)
 	respContent, err := f.HTTPGet(apiUrl)
 	if err != nil {
 		log.Println("Unable to request tumblr api", err)
-		return []ReplyMessage{}, err
+		return []ReplyMessage{}, cursor, err
 	}
 	posts := TumblrPosts{}
 	if err := json.Unmarshal(respContent, &posts); err != nil {
 		log.Println("Unable to load json", err)
-		return []ReplyMessage{}, err
+		return []ReplyMessage{}, cursor, err
 	}
 	if posts.Meta.Status != 200 {
 		log.Println("Tumblr return err. Code", posts.Meta.Status)
-		return []ReplyMessage{}, errors.New("tumblr api error")
+		return []ReplyMessage{}, cursor, errors.New("tumblr api error")
 	}
+	options := f.options(user)
+	next := cursor
 	ret := make([]ReplyMessage, 0, len(posts.Response.Posts))
-	for _, p := range posts.Response.Posts {
-		if p.Type != "photo" && p.Type != "video" {
+	// Posts come newest first, push them in chronological order
+	for i := len(posts.Response.Posts) - 1; i >= 0; i-- {
+		p := posts.Response.Posts[i]
+		if p.ID > next.ID {
+			next.ID = p.ID
+		}
+		// Pinned posts come first, so never stop early
+		if cursor.ID != 0 && p.ID <= cursor.ID {
 			continue
 		}
-		if int64(p.Timestamp) < time {
-			break
+		if cursor.ID == 0 && int64(p.Timestamp) < cursor.Time {
+			continue
 		}
-
-		res := make([]Resource, 0, len(p.Photos))
-		for _, photo := range p.Photos {
-			tType := TIMAGE
-			if strings.HasSuffix(strings.ToLower(photo.OriginalSize.URL), ".gif") {
-				tType = TVIDEO
-			}
-			// Duplicate
-			strsplit := strings.Split(photo.OriginalSize.URL, "/")
-			if len(strsplit) < 4 {
-				continue
-			}
-			imghash := fmt.Sprintf("%s@%s", f.channelId, strsplit[3])
-			_, found := f.cache.Get(imghash)
-			f.cache.Set(imghash, true, cache.DefaultExpiration)
-			if found {
-				continue
-			}
-
-			// Blacklist
-			isBlocked := false
-			if err := f.DB.Get("block", imghash, &isBlocked); err == nil && isBlocked {
-				continue
-			}
-
-			res = append(res, Resource{photo.OriginalSize.URL, tType, photo.OriginalSize.URL})
+		postType := p.postType()
+		if !options.accepts(postType) {
+			continue
 		}
-		if p.VideoURL != "" {
-			urlpath := strings.Split(p.VideoURL, "/")
-			videopath := urlpath[len(urlpath)-1]
-			if strings.Contains(videopath, ".") {
-				videohash := fmt.Sprintf("%s@%s", f.channelId, urlpath[len(urlpath)-1])
-				_, found := f.cache.Get(videohash)
-				f.cache.Set(videohash, true, cache.DefaultExpiration)
-				if !found {
-					res = append(res, Resource{p.VideoURL, TVIDEO, p.VideoURL})
-				}
-			} else {
-				res = append(res, Resource{p.VideoURL, TVIDEO, p.VideoURL})
-			}
+		if f.Blocked(BlockItem, strconv.FormatInt(p.ID, 10)) || f.Blocked(BlockAuthor, p.BlogName) {
+			continue
 		}
-		if len(res) > 0 {
-			ret = append(ret, ReplyMessage{res, p.ShortURL, nil})
+
+		res := f.npfResources(p)
+		// Posts of other types are worth their text alone
+		if len(res) > 0 || (postType != "photo" && postType != "video") {
+			ret = append(ret, tumblrMessage(p, res, posts.Response.Blog.Title, user))
 		}
 	}
-	return ret, nil
+	return ret, next, nil
 }
 
-func (f *TumblrFetcher) GetPush(userID string, followings []string) []ReplyMessage {
-	var lastUpdate int64
-	if err := f.DB.Get("last_update", userID, &lastUpdate); err != nil {
-		lastUpdate = 0
+// tumblrMediaKey gives the hash directory in the path of images, which identifies them
+func tumblrMediaKey(u string) string {
+	if split := strings.Split(u, "/"); len(split) >= 4 && strings.HasSuffix(split[2], "media.tumblr.com") {
+		return split[3]
 	}
+	return u
+}
+
+// mediaBlocked tells whether a media is blocked, keyed the same way as Block does
+func (f *TumblrFetcher) mediaBlocked(u string) bool {
+	return f.Blocked(BlockMedia, tumblrMediaKey(u))
+}
+
+func tumblrMessage(p TumblrPost, res []Resource, blogTitle string, user string) ReplyMessage {
+	caption, markup := p.ShortURL, EscapeHTML(p.ShortURL)
+	if text, html := ConvertHTML(npfBody(p)); text != "" {
+		caption = text + "\n" + caption
+		markup = html + "\n" + markup
+	}
+	return ReplyMessage{
+		Resources:   res,
+		Caption:     caption,
+		CaptionHTML: markup,
+		ID:          strconv.FormatInt(p.ID, 10),
+		Site:        "tumblr",
+		Author:      p.BlogName,
+		AuthorName:  blogTitle,
+		URL:         p.PostURL,
+		Time:        int64(p.Timestamp),
+		Tags:        p.Tags,
+		Following:   user,
+	}
+}
+
+func (f *TumblrFetcher) GetPush(userID string, followings []string) []ReplyMessage {
+	f.migrateCursors(userID, followings)
 	ret := make([]ReplyMessage, 0, 0)
 	for _, follow := range followings {
-		single, err := f.getUserTimeline(follow, lastUpdate)
-		if err == nil {
-			ret = append(ret, single...)
+		cursor := f.GetCursor(userID, follow)
+		single, next, err := f.getUserTimeline(follow, cursor)
+		if err != nil {
+			continue
+		}
+		if cursor == (Cursor{}) {
+			single = firstPush(single)
+		}
+		ret = append(ret, single...)
+		if next != cursor {
+			_ = f.SetCursor(userID, follow, next)
 		}
-	}
-	if len(ret) != 0 {
-		_ = f.DB.Set("last_update", userID, time.Now().Unix())
 	}
 	return ret
 }
 
-func (f *TumblrFetcher) GoBack(userID string, back int64) error {
-	now := time.Now().Unix()
-	if back > now {
-		return errors.New("back too long")
+func (f *TumblrFetcher) Latest(following string, n int) ([]ReplyMessage, error) {
+	f.dryRun = true
+	defer func() { f.dryRun = false }()
+	ret, _, err := f.getUserTimeline(following, Cursor{})
+	// Posts are in chronological order
+	if len(ret) > n {
+		ret = ret[len(ret)-n:]
+	}
+	return ret, err
+}
+
+// Lookup fetches a post of the blog followed, the resources of it are left out
+func (f *TumblrFetcher) Lookup(following string, id string) (ReplyMessage, error) {
+	if f.OAuthConsumerKey == "" {
+		return ReplyMessage{}, errors.New("need API key")
+	}
+	apiUrl := fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/posts?npf=true&id=%s", following, url.QueryEscape(id))
+	respContent, err := f.HTTPGet(apiUrl)
+	if err != nil {
+		return ReplyMessage{}, err
+	}
+	// Errors come with an empty array as the response
+	var meta struct {
+		Meta struct {
+			Status int `json:"status"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(respContent, &meta); err != nil {
+		return ReplyMessage{}, err
+	}
+	switch {
+	case meta.Meta.Status == 404 && f.blogExists(following):
+		return ReplyMessage{}, ErrItemGone
+	case meta.Meta.Status != 200:
+		return ReplyMessage{}, fmt.Errorf("tumblr api error %d", meta.Meta.Status)
+	}
+	posts := TumblrPosts{}
+	if err := json.Unmarshal(respContent, &posts); err != nil {
+		return ReplyMessage{}, err
+	}
+	if len(posts.Response.Posts) == 0 {
+		return ReplyMessage{}, ErrItemGone
 	}
-	return f.DB.Set("last_update", userID, now-back)
+	return tumblrMessage(posts.Response.Posts[0], nil, posts.Response.Blog.Title, following), nil
+}
+
+// blogExists tells whether the blog is still there, a missing post of a renamed or
+// suspended blog is not deleted
+func (f *TumblrFetcher) blogExists(blog string) bool {
+	respContent, err := f.HTTPGet(fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/info", blog))
+	if err != nil {
+		return false
+	}
+	var info struct {
+		Meta struct {
+			Status int `json:"status"`
+		} `json:"meta"`
+	}
+	return json.Unmarshal(respContent, &info) == nil && info.Meta.Status == 200
+}
+
+func (f *TumblrFetcher) GoBack(userID string, followings []string, back int64) error {
+	return f.goBackCursors(userID, followings, back)
 }
 
-func (f *TumblrFetcher) Block(caption string) string {
-	split := strings.Split(caption, "/")
-	if len(split) >= 4 {
-		imgHash := fmt.Sprintf("%s@%s", f.channelId, split[3])
-		_ = f.DB.Set("block", imgHash, true)
-		return fmt.Sprintf("%s blocked.", imgHash)
+// Block keys images by the hash directory in their path, like deduplication does
+func (f *TumblrFetcher) Block(kind string, value string) string {
+	if kind == BlockMedia {
+		value = tumblrMediaKey(value)
 	}
-	return "Unrecognized image caption."
+	return f.BaseFetcher.Block(kind, value)
 }
@@ -0,0 +1,399 @@
+package fetchers
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Limits of photos sent to Telegram, larger ones are refused or downscaled
+const (
+	MaxPhotoSide       = 2560
+	MaxPhotoDimensions = 10000 // Width plus height
+	MaxThumbSide       = 320
+)
+
+// TumblrBlock is a content block of the Neue Post Format
+// ref: https://www.tumblr.com/docs/npf
+type TumblrBlock struct {
+	Type        string             `json:"type"`
+	Subtype     string             `json:"subtype,omitempty"`
+	Text        string             `json:"text,omitempty"`
+	Formatting  []TumblrFormatting `json:"formatting,omitempty"`
+	Media       TumblrMediaList    `json:"media,omitempty"`
+	Poster      []TumblrMedia      `json:"poster,omitempty"`
+	URL         string             `json:"url,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Artist      string             `json:"artist,omitempty"`
+	Provider    string             `json:"provider,omitempty"`
+}
+
+type TumblrFormatting struct {
+	Start int    `json:"start"` // Character offset, inclusive
+	End   int    `json:"end"`   // Character offset, exclusive
+	Type  string `json:"type"`
+	URL   string `json:"url,omitempty"`
+	Blog  struct {
+		URL string `json:"url"`
+	} `json:"blog"`
+}
+
+type TumblrMedia struct {
+	URL     string `json:"url"`
+	Type    string `json:"type"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Cropped bool   `json:"cropped,omitempty"`
+}
+
+// TumblrMediaList is a list of variants for images, and a single object for videos and audio
+type TumblrMediaList []TumblrMedia
+
+func (l *TumblrMediaList) UnmarshalJSON(data []byte) error {
+	if s := strings.TrimSpace(string(data)); strings.HasPrefix(s, "{") {
+		var media TumblrMedia
+		if err := json.Unmarshal(data, &media); err != nil {
+			return err
+		}
+		*l = TumblrMediaList{media}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]TumblrMedia)(l))
+}
+
+type TumblrLayout struct {
+	Type    string `json:"type"`
+	Display []struct {
+		Blocks []int `json:"blocks"`
+	} `json:"display,omitempty"`
+	Blocks      []int `json:"blocks,omitempty"`
+	Attribution struct {
+		Blog struct {
+			Name string `json:"name"`
+		} `json:"blog"`
+	} `json:"attribution"`
+}
+
+// TumblrTrail is a post reblogged, oldest first
+type TumblrTrail struct {
+	Blog struct {
+		Name string `json:"name"`
+	} `json:"blog"`
+	BrokenBlogName string         `json:"broken_blog_name,omitempty"`
+	Content        []TumblrBlock  `json:"content"`
+	Layout         []TumblrLayout `json:"layout"`
+}
+
+// postType gives the legacy type of a post, which is guessed by its blocks if unknown
+func (p TumblrPost) postType() string {
+	switch p.OriginalType {
+	case "regular":
+		return "text"
+	case "conversation":
+		return "chat"
+	case "note":
+		return "answer"
+	case "", "blocks":
+	default:
+		return p.OriginalType
+	}
+	blocks := append([]TumblrBlock{}, p.Content...)
+	for _, t := range p.Trail {
+		blocks = append(blocks, t.Content...)
+	}
+	kinds := map[string]bool{}
+	for _, b := range blocks {
+		kinds[b.Type] = true
+	}
+	for _, t := range []string{"video", "audio", "image", "link"} {
+		if !kinds[t] {
+			continue
+		}
+		if t == "image" {
+			return "photo"
+		}
+		return t
+	}
+	return "text"
+}
+
+// npfOrder gives the indices of blocks in the order shown, the blocks of an ask come first
+func npfOrder(content []TumblrBlock, layout []TumblrLayout) (order []int, ask int, asker string) {
+	added := make([]bool, len(content))
+	add := func(i int) {
+		if i >= 0 && i < len(content) && !added[i] {
+			added[i] = true
+			order = append(order, i)
+		}
+	}
+	for _, l := range layout {
+		if l.Type == "ask" {
+			for _, i := range l.Blocks {
+				add(i)
+			}
+			ask, asker = len(order), l.Attribution.Blog.Name
+		}
+	}
+	for _, l := range layout {
+		if l.Type == "rows" {
+			for _, row := range l.Display {
+				for _, i := range row.Blocks {
+					add(i)
+				}
+			}
+		}
+	}
+	for i := range content {
+		add(i)
+	}
+	return
+}
+
+// Tags of the inline formatting of text blocks
+var npfFormattingTags = map[string]string{
+	"bold":          "b",
+	"italic":        "i",
+	"strikethrough": "s",
+	"link":          "a",
+	"mention":       "a",
+}
+
+func (t TumblrFormatting) openTag() string {
+	tag := npfFormattingTags[t.Type]
+	href := t.URL
+	if t.Type == "mention" {
+		href = t.Blog.URL
+	}
+	if tag == "a" {
+		return `<a href="` + EscapeHTML(href) + `">`
+	}
+	return "<" + tag + ">"
+}
+
+// npfText gives the HTML of the text of a block. Formatting ranges may overlap, so the
+// tags open are closed and reopened wherever a range starts or ends.
+func npfText(b TumblrBlock) string {
+	var out strings.Builder
+	runes := []rune(b.Text)
+	var open []TumblrFormatting
+	closeAll := func() {
+		for i := len(open) - 1; i >= 0; i-- {
+			out.WriteString("</" + npfFormattingTags[open[i].Type] + ">")
+		}
+		open = nil
+	}
+	for i := 0; i < len(runes); i++ {
+		if i == 0 || changedAt(b.Formatting, i) {
+			closeAll()
+			for _, f := range b.Formatting {
+				if _, ok := npfFormattingTags[f.Type]; ok && f.Start <= i && i < f.End {
+					out.WriteString(f.openTag())
+					open = append(open, f)
+				}
+			}
+		}
+		if runes[i] == '\n' {
+			out.WriteString("<br>")
+		} else {
+			out.WriteString(EscapeHTML(string(runes[i])))
+		}
+	}
+	closeAll()
+	return out.String()
+}
+
+// changedAt tells whether a formatting range starts or ends at the offset
+func changedAt(formatting []TumblrFormatting, i int) bool {
+	for _, f := range formatting {
+		if _, ok := npfFormattingTags[f.Type]; ok && (f.Start == i || f.End == i) {
+			return true
+		}
+	}
+	return false
+}
+
+// npfBlockHTML gives the HTML of the text of a block, media are sent as resources instead
+func npfBlockHTML(b TumblrBlock) string {
+	switch b.Type {
+	case "text":
+		text := npfText(b)
+		switch b.Subtype {
+		case "heading1", "heading2":
+			return "<p><b>" + text + "</b></p>"
+		case "quote", "indented":
+			return "<blockquote>" + text + "</blockquote>"
+		case "ordered-list-item", "unordered-list-item":
+			return "<li>" + text + "</li>"
+		case "chat":
+			return "<div>" + text + "</div>"
+		}
+		return "<p>" + text + "</p>"
+	case "link":
+		title := b.Title
+		if title == "" {
+			title = b.URL
+		}
+		ret := `<p><b><a href="` + EscapeHTML(b.URL) + `">` + EscapeHTML(title) + "</a></b></p>"
+		if b.Description != "" {
+			ret += "<p>" + EscapeHTML(b.Description) + "</p>"
+		}
+		return ret
+	case "audio":
+		ret := ""
+		if track := strings.Trim(b.Artist+" - "+b.Title, " -"); track != "" {
+			ret = "<p><b>" + EscapeHTML(track) + "</b></p>"
+		}
+		if len(b.Media) == 0 && b.URL != "" {
+			ret += "<p>" + EscapeHTML(b.URL) + "</p>"
+		}
+		return ret
+	case "video":
+		if len(b.Media) == 0 && b.URL != "" {
+			return "<p>" + EscapeHTML(b.URL) + "</p>"
+		}
+	}
+	return ""
+}
+
+func npfContentHTML(content []TumblrBlock, layout []TumblrLayout) string {
+	var b strings.Builder
+	order, ask, asker := npfOrder(content, layout)
+	if ask > 0 {
+		if asker == "" {
+			asker = "Anonymous"
+		}
+		b.WriteString("<p><b>" + EscapeHTML(asker) + " asked:</b></p><blockquote>")
+	}
+	for n, i := range order {
+		if n == ask && ask > 0 {
+			b.WriteString("</blockquote>")
+		}
+		b.WriteString(npfBlockHTML(content[i]))
+	}
+	if ask > 0 && ask == len(order) {
+		b.WriteString("</blockquote>")
+	}
+	return b.String()
+}
+
+// npfBody gives the HTML of a post in the Neue Post Format, reblogged posts go first
+func npfBody(p TumblrPost) string {
+	var b strings.Builder
+	for _, t := range p.Trail {
+		name := t.Blog.Name
+		if name == "" {
+			name = t.BrokenBlogName
+		}
+		b.WriteString("<p><b>" + EscapeHTML(name) + ":</b></p>")
+		b.WriteString(npfContentHTML(t.Content, t.Layout))
+	}
+	if len(p.Trail) != 0 && len(p.Content) != 0 {
+		b.WriteString("<p><b>" + EscapeHTML(p.BlogName) + ":</b></p>")
+	}
+	b.WriteString(npfContentHTML(p.Content, p.Layout))
+	return b.String()
+}
+
+// bestImage picks the largest variant within the limits of Telegram, or the smallest one if
+// none is. Cropped variants are left out, and so is WebP unless it is the only format.
+func bestImage(media []TumblrMedia) (TumblrMedia, bool) {
+	candidates := make([]TumblrMedia, 0, len(media))
+	for _, m := range media {
+		if !m.Cropped && m.URL != "" && m.Type != "image/webp" {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, m := range media {
+			if !m.Cropped && m.URL != "" {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return TumblrMedia{}, false
+	}
+	best, smallest := -1, 0
+	for i, m := range candidates {
+		if m.Width < candidates[smallest].Width {
+			smallest = i
+		}
+		if m.Width > MaxPhotoSide || m.Height > MaxPhotoSide || m.Width+m.Height > MaxPhotoDimensions {
+			continue
+		}
+		if best < 0 || m.Width > candidates[best].Width {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = smallest
+	}
+	return candidates[best], true
+}
+
+// posterThumb gives the smallest poster of a video which Telegram takes as a thumbnail
+func posterThumb(poster []TumblrMedia) string {
+	ret, width := "", 0
+	for _, m := range poster {
+		if m.Width == 0 || m.Width > MaxThumbSide || m.Height > MaxThumbSide || m.Type == "image/webp" {
+			continue
+		}
+		if ret == "" || m.Width < width {
+			ret, width = m.URL, m.Width
+		}
+	}
+	return ret
+}
+
+// npfResources gives the media of a post in the Neue Post Format not sent or blocked yet
+func (f *TumblrFetcher) npfResources(p TumblrPost) []Resource {
+	var res []Resource
+	add := func(content []TumblrBlock, layout []TumblrLayout) {
+		order, _, _ := npfOrder(content, layout)
+		for _, i := range order {
+			if r, ok := f.npfResource(content[i]); ok {
+				res = append(res, r)
+			}
+		}
+	}
+	for _, t := range p.Trail {
+		add(t.Content, t.Layout)
+	}
+	add(p.Content, p.Layout)
+	return res
+}
+
+func (f *TumblrFetcher) npfResource(b TumblrBlock) (Resource, bool) {
+	switch b.Type {
+	case "image":
+		m, ok := bestImage(b.Media)
+		if !ok {
+			return Resource{}, false
+		}
+		if f.Seen(f.channelId, tumblrMediaKey(m.URL)) || f.mediaBlocked(m.URL) {
+			return Resource{}, false
+		}
+		tType := TIMAGE
+		if m.Type == "image/gif" || strings.HasSuffix(strings.ToLower(m.URL), ".gif") {
+			tType = TVIDEO
+		}
+		return Resource{URL: m.URL, T: tType, Caption: m.URL, Width: m.Width, Height: m.Height}, true
+	case "video":
+		if len(b.Media) == 0 || b.Media[0].URL == "" {
+			return Resource{}, false
+		}
+		m := b.Media[0]
+		name := m.URL[strings.LastIndex(m.URL, "/")+1:]
+		if f.mediaBlocked(m.URL) || (strings.Contains(name, ".") && f.Seen(f.channelId, name)) {
+			return Resource{}, false
+		}
+		return Resource{URL: m.URL, T: TVIDEO, Caption: m.URL, Width: m.Width, Height: m.Height,
+			Thumbnail: posterThumb(b.Poster)}, true
+	case "audio":
+		if len(b.Media) == 0 || b.Media[0].URL == "" || f.mediaBlocked(b.Media[0].URL) {
+			return Resource{}, false
+		}
+		return Resource{URL: b.Media[0].URL, T: TAUDIO, Caption: b.Media[0].URL}, true
+	}
+	return Resource{}, false
+}
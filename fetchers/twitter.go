@@ -1,14 +1,17 @@
 package fetchers
 
 import (
-	"errors"
 	"fmt"
+	"html"
+	"log"
+	"net/http"
 	"net/url"
-	"time"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ChimeraCoder/anaconda"
 	"github.com/asdine/storm"
-	"github.com/patrickmn/go-cache"
 )
 
 type TwitterFetcher struct {
@@ -18,117 +21,568 @@ type TwitterFetcher struct {
 	AccessTokenSecret string `json:"access_token_secret"`
 	ConsumerKey       string `json:"consumer_key"`
 	ConsumerSecret    string `json:"consumer_secret"`
-	cache             *cache.Cache
-	channelId         string
+	MaxPages          int    `json:"max_pages"`     // Pages to fetch until the cursor, DefaultMaxPages if 0
+	MergeThreads      bool   `json:"merge_threads"` // Merge replies to own tweets fetched in one poll
 }
 
 const (
-	MaxTweetCount = "20"
+	MaxTweetCount   = "100" // Tweets per page, the most search gives
+	DefaultMaxPages = 5
+	MaxVideoSize    = 50 << 20 // Largest file bots can upload to Telegram
 )
 
+func init() {
+	Register(Module{
+		ID:   0,
+		Name: "twitter",
+		New:  func() Fetcher { return new(TwitterFetcher) },
+		Env: map[string]string{
+			"TWITTER_TOKEN":        "access_token",
+			"TWITTER_TOKEN_SECRET": "access_token_secret",
+			"TWITTER_KEY":          "consumer_key",
+			"TWITTER_SECRET":       "consumer_secret",
+		},
+	})
+}
+
 func (f *TwitterFetcher) Init(db *storm.DB, channelId string) (err error) {
-	f.DB = db.From("twitter")
+	f.initStore(db, "twitter")
 	f.api = anaconda.NewTwitterApiWithCredentials(f.AccessToken, f.AccessTokenSecret, f.ConsumerKey, f.ConsumerSecret)
-	f.cache = cache.New(cacheExp*time.Hour, cachePurge*time.Hour)
 	f.channelId = channelId
 	return
 }
 
-func (f *TwitterFetcher) getUserTimeline(user string, time int64) ([]ReplyMessage, error) {
-	v := url.Values{}
-	v.Set("count", MaxTweetCount)
-	v.Set("screen_name", user)
+// Kinds of followings, written as kind:value. A following without kind is a user.
+const (
+	TwitterUser    = "user"
+	TwitterList    = "list"    // list:id or list:owner/slug
+	TwitterSearch  = "search"  // search:query
+	TwitterLikes   = "likes"   // likes:screen_name
+	TwitterHashtag = "hashtag" // hashtag:tag or #tag
+)
+
+func parseTwitterFollowing(following string) (kind string, value string) {
+	if strings.HasPrefix(following, "#") {
+		return TwitterHashtag, following[1:]
+	}
+	split := strings.SplitN(following, ":", 2)
+	if len(split) != 2 {
+		return TwitterUser, following
+	}
+	return split[0], split[1]
+}
+
+// Values of options of followings
+const (
+	OptionInclude   = "include"
+	OptionExclude   = "exclude"
+	OptionAttribute = "attribute" // Retweets are shown as the original tweets with their authors
+	OptionSelf      = "self"      // Only replies to own tweets, i.e. threads
+)
+
+// TwitterOptions are how tweets of a following are pushed to a channel
+type TwitterOptions struct {
+	Retweets string // include, exclude or attribute, include if empty
+	Replies  string // include, exclude or self, include if empty
+}
+
+func (o TwitterOptions) String() string {
+	value := func(v string) string {
+		if v == "" {
+			return OptionInclude
+		}
+		return v
+	}
+	return fmt.Sprintf("retweets=%s replies=%s", value(o.Retweets), value(o.Replies))
+}
+
+func (f *TwitterFetcher) options(following string) TwitterOptions {
+	var options TwitterOptions
+	if f.DB != nil {
+		_ = f.DB.Get("options", cursorKey(f.channelId, following), &options)
+	}
+	return options
+}
+
+// Configure sets retweets (include/exclude/attribute) or replies (include/exclude/self) of a following
+func (f *TwitterFetcher) Configure(following string, key string, value string) string {
+	if f.DB == nil {
+		return "Unsupported site."
+	}
+	options := f.options(following)
+	switch {
+	case key == "":
+		return fmt.Sprintf("Options of %s: %s", following, options)
+	case key == "retweets" && (value == OptionInclude || value == OptionExclude || value == OptionAttribute):
+		options.Retweets = value
+	case key == "replies" && (value == OptionInclude || value == OptionExclude || value == OptionSelf):
+		options.Replies = value
+	default:
+		return "Options: retweets=include/exclude/attribute replies=include/exclude/self"
+	}
+	if err := f.DB.Set("options", cursorKey(f.channelId, following), options); err != nil {
+		return fmt.Sprintf("Unable to set option. %s", err)
+	}
+	return fmt.Sprintf("Options of %s: %s", following, options)
+}
+
+// skipTweet tells whether the options leave the tweet out
+func (o TwitterOptions) skipTweet(tweet anaconda.Tweet) bool {
+	if tweet.RetweetedStatus != nil && o.Retweets == OptionExclude {
+		return true
+	}
+	if tweet.InReplyToStatusIdStr != "" {
+		switch o.Replies {
+		case OptionExclude:
+			return true
+		case OptionSelf:
+			return tweet.InReplyToUserIdStr != tweet.User.IdStr
+		}
+	}
+	return false
+}
+
+// seenNamespace keeps dedup of each kind of followings apart, users keep the one of older versions
+func (f *TwitterFetcher) seenNamespace(kind string) string {
+	if kind == TwitterUser {
+		return f.channelId
+	}
+	return f.channelId + "/" + kind
+}
+
+// fetchTweets requests the tweets of a following of any kind
+func (f *TwitterFetcher) fetchTweets(kind string, value string, v url.Values) ([]anaconda.Tweet, error) {
+	switch kind {
+	case TwitterUser:
+		v.Set("screen_name", value)
+		return f.api.GetUserTimeline(v)
+	case TwitterList:
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return f.api.GetListTweets(id, true, v)
+		}
+		split := strings.SplitN(value, "/", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("list %s is neither id nor owner/slug", value)
+		}
+		return f.api.GetListTweetsBySlug(split[1], split[0], true, v)
+	case TwitterSearch, TwitterHashtag:
+		if kind == TwitterHashtag {
+			value = "#" + value
+		}
+		v.Set("result_type", "recent")
+		result, err := f.api.GetSearch(value, v)
+		return result.Statuses, err
+	case TwitterLikes:
+		v.Set("screen_name", value)
+		return f.api.GetFavorites(v)
+	}
+	return nil, fmt.Errorf("unknown kind %s", kind)
+}
+
+// fetchPages requests tweets newest first, page by page with max_id, until the cursor is
+// reached or MaxPages pages are fetched. Without a cursor only the first page is fetched.
+func (f *TwitterFetcher) fetchPages(kind string, value string, cursor Cursor) ([]anaconda.Tweet, error) {
+	maxPages := f.MaxPages
+	if maxPages <= 0 {
+		maxPages = DefaultMaxPages
+	}
+	// Tweets are liked in any order, so likes can't be paged by id
+	if kind == TwitterLikes || cursor == (Cursor{}) {
+		maxPages = 1
+	}
+	results := make([]anaconda.Tweet, 0)
+	var maxId int64
+	for page := 0; page < maxPages; page++ {
+		v := url.Values{}
+		v.Set("count", MaxTweetCount)
+		if cursor.ID != 0 && kind != TwitterLikes {
+			v.Set("since_id", strconv.FormatInt(cursor.ID, 10))
+		}
+		if maxId != 0 {
+			v.Set("max_id", strconv.FormatInt(maxId-1, 10))
+		}
+		tweets, err := f.fetchTweets(kind, value, v)
+		if err != nil {
+			if page == 0 {
+				return results, err
+			}
+			log.Printf("Unable to fetch page %d of twitter %s. %s", page+1, value, err)
+			break
+		}
+		if len(tweets) == 0 {
+			break
+		}
+		results = append(results, tweets...)
+
+		oldest := tweets[len(tweets)-1]
+		for _, tweet := range tweets {
+			if tweet.Id < oldest.Id {
+				oldest = tweet
+			}
+		}
+		if cursor.ID != 0 && oldest.Id <= cursor.ID {
+			break
+		}
+		if createdAt, err := oldest.CreatedAtTime(); cursor.ID == 0 && err == nil && createdAt.Unix() < cursor.Time {
+			break
+		}
+		maxId = oldest.Id
+	}
+	return results, nil
+}
+
+func (f *TwitterFetcher) getUserTimeline(user string, cursor Cursor) ([]ReplyMessage, Cursor, error) {
+	kind, value := parseTwitterFollowing(user)
+	byId := kind != TwitterLikes
 
 	// 拉取用户timeline
-	results, err := f.api.GetUserTimeline(v)
+	results, err := f.fetchPages(kind, value, cursor)
 	if err != nil {
-		return []ReplyMessage{}, err
+		return []ReplyMessage{}, cursor, err
 	}
+	next := cursor
 
+	options := f.options(user)
 	// 构建用于回复message用到的消息
 	ret := make([]ReplyMessage, 0, len(results))
-	// 遍历时间线结果
+	threads := make(map[string]int) // Tweet id => index of the message it is in
+	// 遍历时间线结果，从旧到新推送
 	// ref: https://developer.twitter.com/en/docs/tweets/data-dictionary/overview/tweet-object
-	for _, tweet := range results {
+	for i := len(results) - 1; i >= 0; i-- {
+		tweet := results[i]
 		createdAtTime, err := tweet.CreatedAtTime()
 		if err != nil {
 			continue
 		}
-		tweetTime := createdAtTime.Unix()
-		// 跳过比给定时间早的推文
-		if tweetTime < time {
-			break
+		if tweet.Id > next.ID {
+			next.ID = tweet.Id
+		}
+		// 没有since_id时跳过比给定时间早的推文
+		if cursor.ID == 0 && byId && createdAtTime.Unix() < cursor.Time {
+			continue
 		}
 
-		var msgId string
-		msgId = tweet.QuotedStatusIdStr
-		// 检查推文是否为评论+转推（Quoted and retweet），若独立推文则直接采用自身ID
-		if msgId == "" {
-			msgId = tweet.IdStr
+		// 转推使用原推文ID去重，同一原推文只推送一次；评论转推是独立推文，使用自身ID
+		msgId := tweet.IdStr
+		if tweet.RetweetedStatus != nil {
+			msgId = tweet.RetweetedStatus.IdStr
 		}
-		msgId = fmt.Sprintf("%s@%s", f.channelId, msgId)
-		_, found := f.cache.Get(msgId)
-		f.cache.Set(msgId, true, cache.DefaultExpiration)
-		if found {
+		if f.Blocked(BlockItem, tweet.IdStr) || f.Blocked(BlockAuthor, tweet.User.ScreenName) {
 			continue
 		}
+		if tweet.RetweetedStatus != nil && f.Blocked(BlockAuthor, tweet.RetweetedStatus.User.ScreenName) {
+			continue
+		}
+		if options.skipTweet(tweet) {
+			continue
+		}
+		if f.Seen(f.seenNamespace(kind), msgId) {
+			continue
+		}
+		msg := f.tweetMessage(tweet, user, options)
+		if head, ok := threads[tweet.InReplyToStatusIdStr]; ok && f.MergeThreads &&
+			tweet.InReplyToUserIdStr == tweet.User.IdStr {
+			mergeThread(&ret[head], msg)
+			threads[tweet.IdStr] = head
+			continue
+		}
+		threads[tweet.IdStr] = len(ret)
+		ret = append(ret, msg)
+	}
+	return ret, next, nil
+}
+
+// mergeThread appends a reply of the author to the message of the thread
+func mergeThread(head *ReplyMessage, reply ReplyMessage) {
+	head.Caption = strings.TrimSpace(head.Caption + "\n\n" + reply.Caption)
+	head.CaptionHTML = strings.TrimSpace(head.CaptionHTML + "\n\n" + reply.CaptionHTML)
+	head.Resources = append(head.Resources, reply.Resources...)
+	for _, tag := range reply.Tags {
+		found := false
+		for _, t := range head.Tags {
+			found = found || strings.EqualFold(t, tag)
+		}
+		if !found {
+			head.Tags = append(head.Tags, tag)
+		}
+	}
+	head.Thread = append(head.Thread, reply.ID)
+}
+
+// tweetMessage converts the tweet fetched for the following, blocked media are left out.
+// A quoted tweet follows the text as a block, and its media follows the media of tweet.
+// Retweets to attribute are shown as the original tweets, under the id of the retweet.
+func (f *TwitterFetcher) tweetMessage(tweet anaconda.Tweet, user string, options TwitterOptions) ReplyMessage {
+	if original := tweet.RetweetedStatus; original != nil && options.Retweets == OptionAttribute {
+		msg := f.tweetMessage(*original, user, TwitterOptions{})
+		by := fmt.Sprintf("%s (@%s)", tweet.User.Name, tweet.User.ScreenName)
+		msg.Caption = fmt.Sprintf("🔁 %s retweeted %s (@%s):\n%s", by, original.User.Name, original.User.ScreenName, msg.Caption)
+		msg.CaptionHTML = fmt.Sprintf("🔁 %s retweeted <a href=\"%s\">%s (@%s)</a>:\n%s", EscapeHTML(by), EscapeHTML(msg.URL),
+			EscapeHTML(original.User.Name), EscapeHTML(original.User.ScreenName), msg.CaptionHTML)
+		msg.ID = tweet.IdStr
+		msg.Retweet = true
+		return msg
+	}
+	createdAt := int64(0)
+	if createdAtTime, err := tweet.CreatedAtTime(); err == nil {
+		createdAt = createdAtTime.Unix()
+	}
+	resources := f.tweetMedia(tweet)
+	tags := make([]string, 0, len(tweet.Entities.Hashtags))
+	for _, hashtag := range tweet.Entities.Hashtags {
+		tags = append(tags, hashtag.Text)
+	}
+	text, markup := tweetText(tweet)
+	if quoted := tweet.QuotedStatus; quoted != nil {
+		quote, quoteMarkup := quoteText(*quoted)
+		text = strings.TrimSpace(text + "\n\n" + quote)
+		markup = strings.TrimSpace(markup + "\n\n" + quoteMarkup)
+		resources = append(resources, f.tweetMedia(*quoted)...)
+	}
+	return ReplyMessage{
+		Resources:   resources,
+		Caption:     text,
+		CaptionHTML: markup,
+		ID:          tweet.IdStr,
+		Site:        "twitter",
+		Author:      tweet.User.ScreenName,
+		AuthorName:  tweet.User.Name,
+		URL:         tweetURL(tweet),
+		Time:        createdAt,
+		Tags:        tags,
+		Following:   user,
+		Retweet:     tweet.RetweetedStatus != nil,
+		Reply:       tweet.InReplyToStatusIdStr != "",
+	}
+}
 
-		resources := make([]Resource, 0, len(tweet.ExtendedEntities.Media))
-		// 遍历扩展字段，找图像/视频等资源，注意扩展字段内的才是原始资源
-		// ref: https://developer.twitter.com/en/docs/tweets/data-dictionary/overview/extended-entities-object
-		for _, media := range tweet.ExtendedEntities.Media {
-			var rType int
-			var rURL string
-
-			switch media.Type {
-			case "photo":
-				rType = TIMAGE
-				rURL = media.Media_url_https
-			case "video":
-				rType = TVIDEO
-				if len(media.VideoInfo.Variants) == 0 {
-					continue
-				}
-				rURL = media.VideoInfo.Variants[0].Url
-			case "animated_gif":
-				rType = TVIDEO
-				if len(media.VideoInfo.Variants) == 0 {
-					continue
-				}
-				rURL = media.VideoInfo.Variants[0].Url
+// tweetMedia gives the media of tweet which isn't blocked
+func (f *TwitterFetcher) tweetMedia(tweet anaconda.Tweet) []Resource {
+	resources := make([]Resource, 0, len(tweet.ExtendedEntities.Media))
+	// 遍历扩展字段，找图像/视频等资源，注意扩展字段内的才是原始资源
+	// ref: https://developer.twitter.com/en/docs/tweets/data-dictionary/overview/extended-entities-object
+	for _, media := range tweet.ExtendedEntities.Media {
+		var r Resource
+		switch media.Type {
+		case "photo":
+			r = Resource{URL: media.Media_url_https, T: TIMAGE}
+		case "video", "animated_gif":
+			variant, ok := bestVariant(media.VideoInfo)
+			if !ok {
+				continue
 			}
-			if rURL != "" {
-				resources = append(resources, Resource{rURL, rType, rURL})
+			r = Resource{
+				URL:       variant.Url,
+				T:         TVIDEO,
+				Duration:  int((media.VideoInfo.DurationMillis + 999) / 1000),
+				Width:     media.Sizes.Large.W,
+				Height:    media.Sizes.Large.H,
+				Thumbnail: media.Media_url_https + "?name=thumb",
 			}
+		}
+		if r.URL != "" && !f.Blocked(BlockMedia, r.URL) {
+			r.Caption = r.URL
+			resources = append(resources, r)
+		}
+	}
+	return resources
+}
 
+// bestVariant picks the MP4 of the highest bitrate estimated to fit MaxVideoSize, or the
+// smallest MP4 if none fits. Playlists can't be played by Telegram and are skipped.
+func bestVariant(video anaconda.VideoInfo) (anaconda.Variant, bool) {
+	var best, smallest anaconda.Variant
+	found := false
+	for _, v := range video.Variants {
+		if v.ContentType != "video/mp4" {
+			continue
 		}
-		ret = append(ret, ReplyMessage{resources, tweet.FullText, nil})
+		if !found || v.Bitrate < smallest.Bitrate {
+			smallest = v
+		}
+		found = true
+		// Bitrate is in bits per second, GIFs have none
+		size := int64(v.Bitrate) * video.DurationMillis / 8000
+		if size <= MaxVideoSize && (best.Url == "" || v.Bitrate > best.Bitrate) {
+			best = v
+		}
+	}
+	if best.Url == "" {
+		return smallest, found
 	}
-	return ret, nil
+	return best, found
 }
 
 func (f *TwitterFetcher) GetPush(userID string, followings []string) []ReplyMessage {
-	var lastUpdate int64
-	if err := f.DB.Get("last_update", userID, &lastUpdate); err != nil {
-		lastUpdate = 0
-	}
+	f.migrateCursors(userID, followings)
 	ret := make([]ReplyMessage, 0, 0)
 	for _, follow := range followings {
-		single, err := f.getUserTimeline(follow, lastUpdate)
-		if err == nil {
-			ret = append(ret, single...)
+		cursor := f.GetCursor(userID, follow)
+		single, next, err := f.getUserTimeline(follow, cursor)
+		if err != nil {
+			log.Printf("Unable to fetch twitter timeline of %s. %s", follow, err)
+			continue
+		}
+		// All of them are marked seen
+		if cursor == (Cursor{}) {
+			single = firstPush(single)
+		}
+		ret = append(ret, single...)
+		if next != cursor {
+			_ = f.SetCursor(userID, follow, next)
 		}
-	}
-	if len(ret) != 0 {
-		_ = f.DB.Set("last_update", userID, time.Now().Unix())
 	}
 	return ret
 }
 
-func (f *TwitterFetcher) GoBack(userID string, back int64) error {
-	now := time.Now().Unix()
-	if back > now {
-		return errors.New("back too long")
+func (f *TwitterFetcher) Latest(following string, n int) ([]ReplyMessage, error) {
+	f.dryRun = true
+	defer func() { f.dryRun = false }()
+	ret, _, err := f.getUserTimeline(following, Cursor{})
+	// Tweets are delivered oldest first
+	if len(ret) > n {
+		ret = ret[len(ret)-n:]
 	}
-	return f.DB.Set("last_update", userID, now-back)
+	return ret, err
+}
+
+func (f *TwitterFetcher) Lookup(following string, id string) (ReplyMessage, error) {
+	tweetId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ReplyMessage{}, err
+	}
+	tweet, err := f.api.GetTweet(tweetId, url.Values{})
+	if err != nil {
+		if tweetGone(err) {
+			return ReplyMessage{}, ErrItemGone
+		}
+		return ReplyMessage{}, err
+	}
+	return f.tweetMessage(tweet, following, f.options(following)), nil
+}
+
+// tweetGone tells whether the tweet was deleted or its account suspended, errors of
+// credentials or rate limits must not be taken as a deletion
+func tweetGone(err error) bool {
+	apiErr, ok := err.(*anaconda.ApiError)
+	if !ok {
+		return false
+	}
+	for _, e := range apiErr.Decoded.Errors {
+		switch e.Code {
+		case anaconda.TwitterErrorDoesNotExist, anaconda.TwitterErrorDoesNotExist2,
+			anaconda.TwitterErrorAccountSuspended, 63: // 63: User has been suspended
+			return true
+		}
+	}
+	return apiErr.StatusCode == http.StatusNotFound && len(apiErr.Decoded.Errors) == 0
+}
+
+func (f *TwitterFetcher) GoBack(userID string, followings []string, back int64) error {
+	return f.goBackCursors(userID, followings, back)
+}
+
+// tweetEntity is a part of tweet text replaced by a link
+type tweetEntity struct {
+	start   int
+	token   string // Text of the entity in the tweet
+	href    string // Link target, empty to remove the entity
+	display string // Link text, the entity itself if empty
+	expand  bool   // Replaced by the link target in plain text
+}
+
+func entityStart(indices []int) int {
+	if len(indices) == 0 {
+		return 0
+	}
+	return indices[0]
+}
+
+// asciiLower lowers ASCII letters only, so byte offsets of the text are kept
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// tweetText gives the text of tweet with urls expanded and links to media left out, and its
+// Telegram markup with hashtags, mentions and urls linked. Mentions leading a reply are left out.
+func tweetText(tweet anaconda.Tweet) (string, string) {
+	text := tweet.FullText
+	if r := tweet.DisplayTextRange; len(r) == 2 && r[0] > 0 {
+		if runes := []rune(text); r[0] <= len(runes) {
+			text = string(runes[r[0]:])
+		}
+	}
+	text = html.UnescapeString(text)
+
+	entities := make([]tweetEntity, 0)
+	for _, h := range tweet.Entities.Hashtags {
+		entities = append(entities, tweetEntity{entityStart(h.Indices), "#" + h.Text,
+			"https://twitter.com/hashtag/" + url.PathEscape(h.Text), "", false})
+	}
+	for _, m := range tweet.Entities.User_mentions {
+		entities = append(entities, tweetEntity{entityStart(m.Indices), "@" + m.Screen_name,
+			"https://twitter.com/" + m.Screen_name, "", false})
+	}
+	for _, u := range tweet.Entities.Urls {
+		href := u.Expanded_url
+		// The quoted tweet is shown as a block instead
+		if tweet.QuotedStatus != nil && strings.HasSuffix(href, "/status/"+tweet.QuotedStatusIdStr) {
+			href = ""
+		}
+		entities = append(entities, tweetEntity{entityStart(u.Indices), u.Url, href, u.Display_url, true})
+	}
+	// Links to the media which is sent along
+	for _, m := range tweet.Entities.Media {
+		entities = append(entities, tweetEntity{entityStart(m.Indices), m.Url, "", "", false})
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i].start < entities[j].start })
+
+	// Indices don't match the unescaped text, so entities are looked up in order instead
+	lower := asciiLower(text)
+	var plain, markup strings.Builder
+	pos := 0
+	for _, e := range entities {
+		offset := strings.Index(lower[pos:], asciiLower(e.token))
+		if offset < 0 {
+			continue
+		}
+		plain.WriteString(text[pos : pos+offset])
+		markup.WriteString(EscapeHTML(text[pos : pos+offset]))
+		pos += offset
+		if e.href != "" {
+			display := e.display
+			if display == "" {
+				display = text[pos : pos+len(e.token)]
+			}
+			markup.WriteString(fmt.Sprintf(`<a href="%s">%s</a>`, EscapeHTML(e.href), EscapeHTML(display)))
+			if e.expand {
+				plain.WriteString(e.href)
+			} else {
+				plain.WriteString(text[pos : pos+len(e.token)])
+			}
+		}
+		pos += len(e.token)
+	}
+	plain.WriteString(text[pos:])
+	markup.WriteString(EscapeHTML(text[pos:]))
+	return strings.TrimSpace(plain.String()), strings.TrimSpace(markup.String())
+}
+
+func tweetURL(tweet anaconda.Tweet) string {
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", tweet.User.ScreenName, tweet.IdStr)
+}
+
+// quoteText renders a quoted tweet as a block attributed to its author
+func quoteText(quoted anaconda.Tweet) (string, string) {
+	text, markup := tweetText(quoted)
+	author := fmt.Sprintf("%s (@%s)", quoted.User.Name, quoted.User.ScreenName)
+	link := tweetURL(quoted)
+	return fmt.Sprintf("» %s:\n%s\n%s", author, text, link),
+		fmt.Sprintf("» <a href=\"%s\">%s</a>:\n<i>%s</i>", EscapeHTML(link), EscapeHTML(author), markup)
 }
@@ -3,7 +3,10 @@ package fetchers
 import (
 	"encoding/json"
 	"log"
+	"strconv"
 	"strings"
+
+	"github.com/asdine/storm"
 )
 
 type V2EXFetcher struct {
@@ -41,6 +44,22 @@ type V2EXHot []struct {
 	LastTouched  int `json:"last_touched"`
 }
 
+func init() {
+	Register(Module{
+		ID:   2,
+		Name: "v2ex",
+		New:  func() Fetcher { return new(V2EXFetcher) },
+	})
+}
+
+func (f *V2EXFetcher) Init(db *storm.DB, channelId string) (err error) {
+	_ = f.BaseFetcher.Init(db, channelId)
+	f.initStore(db, "v2ex")
+	f.channelId = channelId
+	return
+}
+
+// GetPush gives the hot topics neither blocked nor pushed to the channel yet
 func (f *V2EXFetcher) GetPush(string, []string) []ReplyMessage {
 	apiUrl := "https://www.v2ex.com/api/topics/hot.json"
 	respContent, err := f.HTTPGet(apiUrl)
@@ -53,9 +72,22 @@ func (f *V2EXFetcher) GetPush(string, []string) []ReplyMessage {
 		log.Println("Unable to load json", err)
 		return []ReplyMessage{{Err: err}}
 	}
-	titles := make([]string, 0, 10)
+	ret := make([]ReplyMessage, 0, len(hot))
 	for _, v := range hot {
-		titles = append(titles, v.Title)
+		id := strconv.Itoa(v.ID)
+		if f.Blocked(BlockItem, id) || f.Blocked(BlockAuthor, v.Member.Username) || f.Seen(f.channelId, id) {
+			continue
+		}
+		ret = append(ret, ReplyMessage{
+			Caption:    strings.Join([]string{v.Title, v.URL}, "\n"),
+			ID:         id,
+			Site:       "v2ex",
+			Author:     v.Member.Username,
+			AuthorName: v.Member.Username,
+			URL:        v.URL,
+			Time:       int64(v.Created),
+			Tags:       []string{v.Node.Name},
+		})
 	}
-	return []ReplyMessage{{Caption: strings.Join(titles, "\n")}}
+	return ret
 }
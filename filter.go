@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+)
+
+// Kinds of filter rules, a message is pushed only if it passes every rule applied to it
+const (
+	FilterInclude   = "include"   // Text contains one of the comma separated keywords
+	FilterExclude   = "exclude"   // Text contains none of the comma separated keywords
+	FilterRegex     = "regex"     // Text matches the regular expression
+	FilterNotRegex  = "noregex"   // Text doesn't match the regular expression
+	FilterMediaOnly = "media"     // Has media
+	FilterTextOnly  = "text"      // Has no media
+	FilterNoRetweet = "noretweet" // Not shared from another account
+	FilterNoReply   = "noreply"   // Not a reply
+	FilterMinMedia  = "minmedia"  // Has at least N media
+)
+
+// Kinds of rules and whether they take a value
+var filterKinds = map[string]bool{
+	FilterInclude:   true,
+	FilterExclude:   true,
+	FilterRegex:     true,
+	FilterNotRegex:  true,
+	FilterMediaOnly: false,
+	FilterTextOnly:  false,
+	FilterNoRetweet: false,
+	FilterNoReply:   false,
+	FilterMinMedia:  true,
+}
+
+type FilterRule struct {
+	Module    int    // -1 for every site
+	Following string // Empty for every following of the site
+	Kind      string
+	Value     string
+}
+
+var (
+	filterRegexes     = make(map[string]*regexp.Regexp)
+	filterRegexesLock sync.Mutex
+)
+
+func filterRegex(expr string) (*regexp.Regexp, error) {
+	filterRegexesLock.Lock()
+	defer filterRegexesLock.Unlock()
+	if re, ok := filterRegexes[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	filterRegexes[expr] = re
+	return re, nil
+}
+
+// ParseFilterRule parses the scope (all, site or site:following), kind and value of a rule
+func ParseFilterRule(scope string, kind string, value string) (FilterRule, error) {
+	rule := FilterRule{Module: -1, Kind: kind, Value: value}
+	if scope != "all" {
+		split := strings.SplitN(scope, ":", 2)
+		rule.Module = MakeModuleLabeler().Str2Module(split[0])
+		if rule.Module == -1 {
+			return rule, errors.New("unsupported site")
+		}
+		if len(split) == 2 {
+			rule.Following = split[1]
+		}
+	}
+
+	takesValue, ok := filterKinds[kind]
+	switch {
+	case !ok:
+		return rule, fmt.Errorf("unknown kind %s", kind)
+	case takesValue && value == "":
+		return rule, fmt.Errorf("%s needs a value", kind)
+	case !takesValue && value != "":
+		return rule, fmt.Errorf("%s takes no value", kind)
+	}
+	switch kind {
+	case FilterRegex, FilterNotRegex:
+		if _, err := filterRegex(value); err != nil {
+			return rule, err
+		}
+	case FilterMinMedia:
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			return rule, errors.New("minmedia needs a positive number")
+		}
+	}
+	return rule, nil
+}
+
+func (r FilterRule) String() string {
+	scope := "all"
+	if r.Module != -1 {
+		scope = MakeModuleLabeler().Module2Str(r.Module)
+		if r.Following != "" {
+			scope += ":" + r.Following
+		}
+	}
+	return strings.TrimSpace(strings.Join([]string{scope, r.Kind, r.Value}, " "))
+}
+
+func (r FilterRule) appliesTo(moduleId int, following string) bool {
+	return (r.Module == -1 || r.Module == moduleId) && (r.Following == "" || r.Following == following)
+}
+
+func containsKeyword(text string, keywords string) bool {
+	for _, k := range strings.Split(strings.ToLower(keywords), ",") {
+		if k = strings.TrimSpace(k); k != "" && strings.Contains(text, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pass tells whether the message passes the rule
+func (r FilterRule) Pass(message f.ReplyMessage) bool {
+	text := message.Caption
+	if len(message.Tags) != 0 {
+		text += "\n#" + strings.Join(message.Tags, " #")
+	}
+	switch r.Kind {
+	case FilterInclude:
+		return containsKeyword(strings.ToLower(text), r.Value)
+	case FilterExclude:
+		return !containsKeyword(strings.ToLower(text), r.Value)
+	case FilterRegex, FilterNotRegex:
+		re, err := filterRegex(r.Value)
+		if err != nil {
+			return true
+		}
+		return re.MatchString(text) == (r.Kind == FilterRegex)
+	case FilterMediaOnly:
+		return len(message.Resources) != 0
+	case FilterTextOnly:
+		return len(message.Resources) == 0
+	case FilterNoRetweet:
+		return !message.Retweet
+	case FilterNoReply:
+		return !message.Reply
+	case FilterMinMedia:
+		n, _ := strconv.Atoi(r.Value)
+		return len(message.Resources) >= n
+	}
+	return true
+}
+
+// filterMessage returns the first rule of channel the message fails, nil if it passes
+func (cset *ChannelSetting) filterMessage(moduleId int, message f.ReplyMessage) *FilterRule {
+	if cset.Filters == nil {
+		return nil
+	}
+	for i, rule := range *cset.Filters {
+		if rule.appliesTo(moduleId, message.Following) && !rule.Pass(message) {
+			return &(*cset.Filters)[i]
+		}
+	}
+	return nil
+}
+
+// applyFilters drops fetched messages which fail the filter rules of channel
+func (c *Channel) applyFilters(moduleId int, messages []f.ReplyMessage) []f.ReplyMessage {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := make([]f.ReplyMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Err == nil {
+			if rule := c.filterMessage(moduleId, msg); rule != nil {
+				log.Printf("Message %s for %s filtered by rule: %s", msg.ID, c.ID, rule)
+				continue
+			}
+		}
+		ret = append(ret, msg)
+	}
+	return ret
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/asdine/storm"
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+	bolt "go.etcd.io/bbolt"
+)
+
+// OutboxEntry is a fetched message waiting to be sent to a channel.
+// Entries are kept in bolt until Telegram accepts them, so they survive restarts.
+type OutboxEntry struct {
+	ID          uint64 `storm:"id,increment"`
+	Module      int
+	Message     f.ReplyMessage
+	Created     int64
+	Attempts    int
+	NextAttempt int64 // Unix time before which the entry should not be retried
+	LastError   string
+	SentParts   int   // Parts delivered before a failure, a retry resumes from here
+	SentIDs     []int // Ids of messages of the parts delivered
+}
+
+func outboxOf(db *storm.DB, channelId string) storm.Node {
+	return db.From("outbox", channelId)
+}
+
+// Enqueue stores messages in the outbox of channel and wakes up the sender
+func (c *Channel) Enqueue(moduleId int, messages []f.ReplyMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	for _, msg := range messages {
+		if msg.Err != nil {
+			log.Println("Drop message with error", msg.Err)
+			continue
+		}
+		entry := OutboxEntry{Module: moduleId, Message: msg, Created: time.Now().Unix()}
+		if err := c.Outbox.Save(&entry); err != nil {
+			log.Println("Unable to save message to outbox", err)
+		}
+	}
+	select {
+	case c.OutboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// PeekOutbox returns at most n pending entries, oldest first
+func (c *Channel) PeekOutbox(n int) []OutboxEntry {
+	var entries []OutboxEntry
+	if err := c.Outbox.All(&entries, storm.Limit(n)); err != nil {
+		log.Println("Unable to read outbox", err)
+		return []OutboxEntry{}
+	}
+	return entries
+}
+
+func (c *Channel) OutboxSize() int {
+	n, err := c.Outbox.Count(&OutboxEntry{})
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// AckOutbox removes an entry once it has been delivered
+func (c *Channel) AckOutbox(entry OutboxEntry) {
+	if err := c.Outbox.DeleteStruct(&entry); err != nil {
+		log.Println("Unable to remove message from outbox", err)
+	}
+}
+
+func (c *Channel) PurgeOutbox() error {
+	err := c.Outbox.Drop(&OutboxEntry{})
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
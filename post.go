@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+	tb "github.com/ihciah/telebot"
+)
+
+// Buttons under delivered posts
+const (
+	ButtonsAll    = "all"    // Source link and admin actions
+	ButtonsSource = "source" // Source link only
+	ButtonsNone   = "none"
+)
+
+// Callback actions of the buttons
+const (
+	actionBlock    = "block"
+	actionMute     = "mute"
+	actionUnfollow = "unfollow"
+)
+
+const MuteDuration = 24 * time.Hour
+
+const (
+	PostRetention      = 30 * 24 * time.Hour // Older posts lose their buttons and whence
+	PrunePostsInterval = 24 * time.Hour
+)
+
+// SentPost is a message delivered to a channel, the ledger of posts maps Telegram messages to their source
+type SentPost struct {
+	ID        uint64 `storm:"id,increment"`
+	Channel   string `storm:"index"`
+	ChatID    int64  `storm:"index"`
+	Messages  []int  // Telegram ids of the messages sent for the post, including every album part
+	Module    int
+	Following string
+	ItemID    string   `storm:"index"`
+	Thread    []string // Ids of replies merged into the item
+	Author    string
+	URL       string
+	Caption   string // Caption given by the fetcher, to tell edits of the source
+	Resources []f.Resource
+	Sent      int64 `storm:"index"`
+	// The last message only carries the keyboard, albums can't
+	KeyboardMessage bool
+}
+
+func postsOf(db *storm.DB) storm.Node {
+	return db.From("posts")
+}
+
+// Bucket of post ids keyed by chat and message id
+const postMessagesBucket = "messages"
+
+func postMessageKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
+
+func (c *Channel) buttons() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.PostButtons == "" {
+		return ButtonsAll
+	}
+	return c.PostButtons
+}
+
+// preparePost records the message about to be sent and builds its keyboard, the keyboard is nil if no buttons are shown
+func (c *Channel) preparePost(moduleId int, message f.ReplyMessage) (*SentPost, *tb.ReplyMarkup) {
+	post := &SentPost{
+		Channel:   c.ID,
+		ChatID:    c.Chat.ID,
+		Module:    moduleId,
+		Following: message.Following,
+		ItemID:    message.ID,
+		Thread:    message.Thread,
+		Author:    message.Author,
+		URL:       message.URL,
+		Caption:   message.Caption,
+		Resources: message.Resources,
+		Sent:      time.Now().Unix(),
+	}
+	if err := postsOf(c.DB).Save(post); err != nil {
+		log.Println("Unable to save post", err)
+		post = nil
+	}
+	return post, c.postKeyboard(message.URL, post)
+}
+
+// postKeyboard builds the buttons under a post, nil if none is shown
+func (c *Channel) postKeyboard(url string, post *SentPost) *tb.ReplyMarkup {
+	buttons := c.buttons()
+	if buttons == ButtonsNone || (buttons == ButtonsSource && url == "") {
+		return nil
+	}
+	keyboard := &tb.ReplyMarkup{}
+	if url != "" {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tb.InlineButton{{Text: "Open source", URL: url}})
+	}
+	if buttons == ButtonsSource || post == nil {
+		if len(keyboard.InlineKeyboard) == 0 {
+			return nil
+		}
+		return keyboard
+	}
+
+	data := func(action string) string {
+		return action + "|" + strconv.FormatUint(post.ID, 10)
+	}
+	actions := make([]tb.InlineButton, 0, 3)
+	if len(post.Resources) != 0 {
+		actions = append(actions, tb.InlineButton{Text: "Block this media", Data: data(actionBlock)})
+	}
+	if post.Author != "" {
+		actions = append(actions, tb.InlineButton{Text: "Mute this account for 24h", Data: data(actionMute)})
+	}
+	if post.Following != "" {
+		actions = append(actions, tb.InlineButton{Text: "Unfollow account", Data: data(actionUnfollow)})
+	}
+	if len(actions) != 0 {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, actions)
+	}
+	if len(keyboard.InlineKeyboard) == 0 {
+		return nil
+	}
+	return keyboard
+}
+
+// sentPost keeps the ids of messages delivered for the post and indexes them
+func (c *Channel) sentPost(post *SentPost, messages []int) {
+	if post == nil || len(messages) == 0 {
+		return
+	}
+	post.Messages = messages
+	post.Sent = time.Now().Unix()
+	if err := postsOf(c.DB).Update(post); err != nil {
+		log.Println("Unable to update post", err)
+		return
+	}
+	for _, id := range messages {
+		if err := postsOf(c.DB).Set(postMessagesBucket, postMessageKey(post.ChatID, id), post.ID); err != nil {
+			log.Println("Unable to index post", err)
+		}
+	}
+}
+
+// findPost looks up the post a message of the chat was sent for
+func findPost(db *storm.DB, chatID int64, messageID int) (SentPost, bool) {
+	var post SentPost
+	var id uint64
+	if err := postsOf(db).Get(postMessagesBucket, postMessageKey(chatID, messageID), &id); err == nil {
+		if err := postsOf(db).One("ID", id, &post); err == nil {
+			return post, true
+		}
+	}
+
+	// Posts sent before the index was kept
+	var posts []SentPost
+	if err := postsOf(db).Find("ChatID", chatID, &posts); err != nil {
+		return post, false
+	}
+	for i := len(posts) - 1; i >= 0; i-- {
+		for _, id := range posts[i].Messages {
+			if id == messageID {
+				return posts[i], true
+			}
+		}
+	}
+	return post, false
+}
+
+func (post SentPost) String() string {
+	lines := []string{"Site: " + MakeModuleLabeler().Module2Str(post.Module)}
+	for _, field := range [][2]string{
+		{"Following", post.Following},
+		{"Item", post.ItemID},
+		{"Author", post.Author},
+		{"Source", post.URL},
+	} {
+		if field[1] != "" {
+			lines = append(lines, field[0]+": "+field[1])
+		}
+	}
+	lines = append(lines, "Sent: "+time.Unix(post.Sent, 0).Format("2006-01-02 15:04:05"))
+	return strings.Join(lines, "\n")
+}
+
+// dropPost forgets a post which was not delivered or was deleted
+func (c *Channel) dropPost(post *SentPost) {
+	if post == nil {
+		return
+	}
+	forgetPost(c.DB, post)
+}
+
+func forgetPost(db *storm.DB, post *SentPost) {
+	for _, id := range post.Messages {
+		_ = postsOf(db).Delete(postMessagesBucket, postMessageKey(post.ChatID, id))
+	}
+	if err := postsOf(db).DeleteStruct(post); err != nil {
+		log.Println("Unable to delete post", err)
+	}
+}
+
+// PrunePosts forgets posts older than the retention period once in a while, the ledger keeps
+// every resource of posts
+func PrunePosts(db *storm.DB) {
+	for {
+		prunePosts(db, time.Now().Add(-PostRetention).Unix())
+		time.Sleep(PrunePostsInterval)
+	}
+}
+
+func prunePosts(db *storm.DB, before int64) {
+	var posts []SentPost
+	if err := postsOf(db).Select(q.Lt("Sent", before)).Find(&posts); err != nil {
+		if err != storm.ErrNotFound {
+			log.Println("Unable to find old posts", err)
+		}
+		return
+	}
+	for i := range posts {
+		forgetPost(db, &posts[i])
+	}
+	log.Printf("Pruned %d post(s) sent before %s.", len(posts), time.Unix(before, 0).Format("2006-01-02"))
+}
+
+func muteKey(moduleId int, author string) string {
+	return fmt.Sprintf("%d@%s", moduleId, author)
+}
+
+func (cset *ChannelSetting) isMuted(moduleId int, author string) bool {
+	if cset.Mutes == nil || author == "" {
+		return false
+	}
+	until, ok := (*cset.Mutes)[muteKey(moduleId, author)]
+	return ok && time.Now().Unix() < until
+}
+
+// handleCallback runs the admin actions of buttons under posts
+func (t *TelegramBot) handleCallback(cb *tb.Callback) {
+	respond := func(text string) {
+		// Telegram shows at most 200 characters
+		if runes := []rune(text); len(runes) > 200 {
+			text = string(runes[:199]) + "…"
+		}
+		_ = t.Bot.Respond(cb, &tb.CallbackResponse{Text: text, ShowAlert: true})
+	}
+	split := strings.SplitN(cb.Data, "|", 2)
+	if len(split) != 2 {
+		respond("Unrecognized action.")
+		return
+	}
+	id, _ := strconv.ParseUint(split[1], 10, 64)
+	var post SentPost
+	if err := postsOf(t.Database).One("ID", id, &post); err != nil {
+		respond("This post is too old.")
+		return
+	}
+	for _, v := range *t.Channels {
+		if v.ID != post.Channel {
+			continue
+		}
+		if cb.Sender == nil || !authUser(cb.Sender, *v.AdminUserIDs, t.Admins) {
+			respond("Unauthorized.")
+			return
+		}
+		respond(v.postAction(split[0], post))
+		return
+	}
+	respond("No such channel/chat")
+}
+
+func (c *Channel) postAction(action string, post SentPost) string {
+	site := MakeModuleLabeler().Module2Str(post.Module)
+	switch action {
+	case actionBlock:
+		return c.blockPost(f.BlockMedia, post)
+	case actionMute:
+		c.Mute(AccountMute{post.Module, post.Author, time.Now().Add(MuteDuration).Unix()})
+		return fmt.Sprintf("%s on %s muted for 24h.", post.Author, site)
+	case actionUnfollow:
+		c.DelFollowing(ModuleUser{post.Module, post.Following})
+		return fmt.Sprintf("%s on %s unfollowed.", post.Following, site)
+	}
+	return "Unrecognized action."
+}
+
+// blockPost blocks the item, media or author of the post for the channel
+func (c *Channel) blockPost(kind string, post SentPost) string {
+	fetcher := c.TgBot.CreateModule(post.Module, c.ID)
+	switch kind {
+	case f.BlockItem:
+		return fetcher.Block(kind, post.ItemID)
+	case f.BlockAuthor:
+		return fetcher.Block(kind, post.Author)
+	case f.BlockMedia:
+		if len(post.Resources) == 0 {
+			return "No media to block."
+		}
+		results := make([]string, 0, len(post.Resources))
+		for _, r := range post.Resources {
+			results = append(results, fetcher.Block(kind, r.URL))
+		}
+		return strings.Join(results, "\n")
+	}
+	return fmt.Sprintf("Unknown block kind %s.", kind)
+}
+
+// Commands sent as replies to delivered posts
+const (
+	replyBlock  = "block"
+	replyWhence = "whence"
+)
+
+// replyCommand returns the command of a reply to a post, empty if it is not one
+func replyCommand(m *tb.Message) string {
+	params := strings.Fields(m.Text)
+	if m.ReplyTo == nil || len(params) == 0 {
+		return ""
+	}
+	switch cmd := strings.ToLower(params[0]); cmd {
+	case replyBlock, replyWhence:
+		return cmd
+	}
+	return ""
+}
+
+// handleReply runs the command replied to a post on its source:
+// "block [media|item|author]" blocks it and "whence" tells where it came from
+func (t *TelegramBot) handleReply(m *tb.Message) string {
+	params := strings.Fields(m.Text)
+	cmd := replyCommand(m)
+	if (cmd == replyBlock && len(params) > 2) || (cmd == replyWhence && len(params) > 1) {
+		return "Usage: reply block [media|item|author] or whence to a post"
+	}
+	return t.onPost(m.Sender, m.Chat, m.ReplyTo, cmd, params)
+}
+
+// onPost runs the command on the source of the post, which is a copy forwarded from the
+// channel when the command comes in a private chat
+func (t *TelegramBot) onPost(sender *tb.User, chat *tb.Chat, m *tb.Message, cmd string, params []string) string {
+	chatID, messageID := chat.ID, m.ID
+	if chat.Type == tb.ChatPrivate {
+		original, ok := t.Forwards.Original(chat.ID, m.ID)
+		if m.OriginalChat == nil || !ok {
+			return "Forward the post from the channel, then reply to it."
+		}
+		chatID, messageID = m.OriginalChat.ID, original
+	}
+	post, ok := findPost(t.Database, chatID, messageID)
+	if !ok {
+		return "Unable to find the source of this post."
+	}
+	for _, v := range *t.Channels {
+		if v.ID != post.Channel {
+			continue
+		}
+		// Only admins can post in channels, where the sender is hidden
+		if sender != nil && !authUser(sender, *v.AdminUserIDs, t.Admins) {
+			return "Unauthorized."
+		}
+		if cmd == replyWhence {
+			return post.String()
+		}
+		kind := f.BlockMedia
+		if len(params) == 2 {
+			kind = params[1]
+		}
+		return v.blockPost(kind, post)
+	}
+	return "No such channel/chat"
+}
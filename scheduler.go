@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tb "github.com/ihciah/telebot"
+)
+
+// Telegram allows about 30 messages per second in total, and 20 messages per minute in the same group or channel
+const (
+	GlobalMessagesPerSecond = 30
+	ChatMessagesPerMinute   = 20
+	ChatMessageBurst        = 3
+)
+
+type tokenBucket struct {
+	rate   float64 // Tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait before using them.
+// Requests larger than the burst only wait for a full bucket and leave the bucket in debt.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	var delay time.Duration
+	if b.tokens < need {
+		delay = time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens -= n
+	return delay
+}
+
+// SendScheduler spreads outgoing messages of all channels over the global and per chat budgets
+type SendScheduler struct {
+	lock   sync.Mutex
+	global *tokenBucket
+	chats  map[string]*tokenBucket
+}
+
+func NewSendScheduler() *SendScheduler {
+	return &SendScheduler{
+		global: newTokenBucket(GlobalMessagesPerSecond, GlobalMessagesPerSecond),
+		chats:  make(map[string]*tokenBucket),
+	}
+}
+
+// chatKey gives the numeric id of the recipient, so a channel addressed by @username and
+// by its id draws from the same budget
+func chatKey(to tb.Recipient) string {
+	if chat, ok := to.(*tb.Chat); ok && chat.ID != 0 {
+		return strconv.FormatInt(chat.ID, 10)
+	}
+	return to.Recipient()
+}
+
+// groupChat tells whether the chat is a group or channel, which have negative ids or usernames.
+// Private chats have positive ids.
+func groupChat(chatId string) bool {
+	return strings.HasPrefix(chatId, "-") || strings.HasPrefix(chatId, "@")
+}
+
+// Wait blocks until n messages may be sent to the chat, which is keyed by its numeric id.
+// Only groups and channels have a budget of their own.
+func (s *SendScheduler) Wait(chatId string, n int) {
+	s.lock.Lock()
+	now := time.Now()
+	delay := s.global.reserve(now, float64(n))
+	if groupChat(chatId) {
+		chat, ok := s.chats[chatId]
+		if !ok {
+			chat = newTokenBucket(ChatMessagesPerMinute/60.0, ChatMessageBurst)
+			s.chats[chatId] = chat
+		}
+		if chatDelay := chat.reserve(now, float64(n)); chatDelay > delay {
+			delay = chatDelay
+		}
+	}
+	s.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Telegram limits of captions and texts, counted in UTF-16 code units after parsing entities
+const (
+	MaxCaptionLength = 1024
+	MaxTextLength    = 4096
+)
+
+// Kinds of places to split a text at, better ones last
+const (
+	breakNone = iota
+	breakWord
+	breakSentence
+	breakLine
+	breakParagraph
+)
+
+// textUnit is a piece of text which can't be split: a character, an HTML entity or a tag
+type textUnit struct {
+	s     string
+	width int    // UTF-16 length after parsing
+	tag   string // Name of the tag, with a leading / for closing ones
+}
+
+func nextUnit(s string, isHTML bool) textUnit {
+	if isHTML {
+		switch s[0] {
+		case '<':
+			// An empty <> is a literal character
+			if end := strings.IndexByte(s, '>'); end > 0 {
+				if fields := strings.Fields(s[1:end]); len(fields) != 0 {
+					return textUnit{s[:end+1], 0, strings.ToLower(fields[0])}
+				}
+			}
+		case '&':
+			if end := strings.IndexByte(s, ';'); end > 0 && end < 12 {
+				if decoded := html.UnescapeString(s[:end+1]); decoded != s[:end+1] {
+					return textUnit{s[:end+1], utf16Length(decoded), ""}
+				}
+			}
+		}
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return textUnit{s[:size], utf16.RuneLen(r), ""}
+}
+
+func utf16Length(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// textLength counts the characters of text as Telegram does
+func textLength(s string, isHTML bool) int {
+	n := 0
+	for len(s) > 0 {
+		u := nextUnit(s, isHTML)
+		n += u.width
+		s = s[len(u.s):]
+	}
+	return n
+}
+
+func sentenceEnd(r rune) bool {
+	return strings.ContainsRune(".!?;。！？；…", r)
+}
+
+// cutText splits text into a head of at most limit characters and the rest, preferring
+// paragraph, line, sentence and word boundaries. Tags open at the cut are closed at the
+// end of head and opened again at the start of rest.
+func cutText(s string, isHTML bool, limit int) (head string, rest string) {
+	if textLength(s, isHTML) <= limit {
+		return s, ""
+	}
+
+	type cut struct {
+		pos   int
+		width int
+		open  []textUnit // Tags open at the cut
+	}
+	var cuts [breakParagraph + 1]cut // Last cut of each kind, breakNone for any character
+	var open []textUnit
+	width, pos := 0, 0
+	var last rune
+	for pos < len(s) {
+		u := nextUnit(s[pos:], isHTML)
+		if width+u.width > limit {
+			break
+		}
+		width += u.width
+		pos += len(u.s)
+		if u.tag != "" {
+			if strings.HasPrefix(u.tag, "/") {
+				for i := len(open) - 1; i >= 0; i-- {
+					if "/"+open[i].tag == u.tag {
+						open = open[:i]
+						break
+					}
+				}
+			} else if !strings.HasSuffix(u.s, "/>") {
+				open = append(open, u)
+			}
+			continue
+		}
+
+		r, _ := utf8.DecodeRuneInString(html.UnescapeString(u.s))
+		kind := breakNone
+		switch {
+		case r == '\n' && last == '\n':
+			kind = breakParagraph
+		case r == '\n':
+			kind = breakLine
+		case unicode.IsSpace(r) && sentenceEnd(last), sentenceEnd(r) && r >= 0x3000:
+			kind = breakSentence
+		case unicode.IsSpace(r):
+			kind = breakWord
+		}
+		last = r
+		tags := append([]textUnit{}, open...)
+		cuts[breakNone] = cut{pos, width, tags}
+		if kind != breakNone {
+			cuts[kind] = cut{pos, width, tags}
+		}
+	}
+
+	// The best boundary which keeps at least half of the limit in head, or else the best one found
+	chosen := cuts[breakNone]
+	for _, minWidth := range []int{limit / 2, 1} {
+		found := false
+		for kind := breakParagraph; kind > breakNone; kind-- {
+			if cuts[kind].pos > 0 && cuts[kind].width >= minWidth {
+				chosen, found = cuts[kind], true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	if chosen.pos == 0 {
+		// Nothing fits, take one unit to make progress
+		chosen.pos = len(nextUnit(s, isHTML).s)
+	}
+
+	head, rest = s[:chosen.pos], s[chosen.pos:]
+	var closing, opening strings.Builder
+	for i := len(chosen.open) - 1; i >= 0; i-- {
+		closing.WriteString("</" + chosen.open[i].tag + ">")
+	}
+	for _, u := range chosen.open {
+		opening.WriteString(u.s)
+	}
+	return strings.TrimRightFunc(head, unicode.IsSpace) + closing.String(),
+		opening.String() + strings.TrimLeftFunc(rest, unicode.IsSpace)
+}
+
+// isBlank tells whether the text shows nothing, e.g. only tags left by a cut
+func isBlank(s string, isHTML bool) bool {
+	for len(s) > 0 {
+		u := nextUnit(s, isHTML)
+		if u.tag == "" && strings.TrimSpace(html.UnescapeString(u.s)) != "" {
+			return false
+		}
+		s = s[len(u.s):]
+	}
+	return true
+}
+
+// splitText splits text into parts of at most limit characters
+func splitText(s string, isHTML bool, limit int) []string {
+	parts := make([]string, 0, 1)
+	for s != "" {
+		head, rest := cutText(s, isHTML, limit)
+		if !isBlank(head, isHTML) {
+			parts = append(parts, head)
+		}
+		s = rest
+	}
+	return parts
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+	tb "github.com/ihciah/telebot"
+)
+
+const (
+	SyncInterval = 30 * time.Minute
+	// Bots can only delete messages sent in the last 48 hours
+	MaxSyncWindow = 48 * 60 * 60
+)
+
+// SyncPosts keeps posts delivered in the sync window in sync with their sources until control is signaled
+func (c *Channel) SyncPosts(control chan int) {
+	for {
+		nextStart := time.After(SyncInterval)
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Println("Panic!", err)
+				}
+			}()
+			c.syncPosts()
+		}()
+		select {
+		case <-control:
+			return
+		case <-nextStart:
+			continue
+		}
+	}
+}
+
+// syncPosts deletes the posts whose source items are gone and edits the ones whose captions changed
+func (c *Channel) syncPosts() {
+	now := time.Now().Unix()
+	c.lock.RLock()
+	since := now - int64(c.SyncWindow)
+	c.lock.RUnlock()
+	var posts []SentPost
+	if err := postsOf(c.DB).Range("Sent", since, now, &posts); err != nil {
+		return
+	}
+	fetchers := make(map[int]f.Fetcher)
+	for _, post := range posts {
+		if post.Channel != c.ID || post.ItemID == "" || len(post.Messages) == 0 {
+			continue
+		}
+		fetcher, ok := fetchers[post.Module]
+		if !ok {
+			fetcher = c.TgBot.CreateModule(post.Module, c.ID)
+			fetchers[post.Module] = fetcher
+		}
+		if fetcher == nil {
+			continue
+		}
+		latest, err := fetcher.Lookup(post.Following, post.ItemID)
+		switch {
+		case err == f.ErrUnsupported:
+			// Skip the rest of posts of the module
+			fetchers[post.Module] = nil
+		case err == f.ErrItemGone:
+			c.deletePost(post)
+		case err != nil:
+			log.Printf("Unable to look up %s of post #%d for %s. %s", post.ItemID, post.ID, c.ID, err)
+		case latest.Caption != post.Caption && len(post.Thread) == 0:
+			// Only the first tweet of a merged thread is looked up, so its caption never matches
+			c.editPost(post, latest)
+		}
+	}
+}
+
+// deletePost removes the messages of a post whose source was deleted
+func (c *Channel) deletePost(post SentPost) {
+	for _, id := range post.Messages {
+		msg := tb.StoredMessage{MessageID: strconv.Itoa(id), ChatID: post.ChatID}
+		if err := c.TgBot.Bot.Delete(msg); err != nil {
+			log.Printf("Unable to delete message %d of post #%d for %s. %s", id, post.ID, c.ID, err)
+		}
+	}
+	log.Printf("Post #%d for %s deleted, %s is gone.", post.ID, c.ID, post.ItemID)
+	c.dropPost(&post)
+}
+
+// mediaMessages counts the messages sent for the resources of a post
+func mediaMessages(resources []f.Resource) int {
+	n := 0
+	for _, album := range planAlbums(resources) {
+		n += len(album)
+	}
+	return n
+}
+
+// editPost replaces the caption of a post whose source was edited. The caption is only
+// edited if it was sent in one message and the new one still fits in a message.
+func (c *Channel) editPost(post SentPost, latest f.ReplyMessage) {
+	isCaption := len(post.Resources) != 0
+	limit, captionMessages := MaxTextLength, 1
+	if isCaption {
+		limit, captionMessages = MaxCaptionLength, mediaMessages(post.Resources)
+	}
+	if post.KeyboardMessage {
+		captionMessages++
+	}
+	if len(post.Messages) != captionMessages {
+		log.Printf("Post #%d for %s edited upstream but it is split, skip.", post.ID, c.ID)
+		return
+	}
+
+	latest.Resources = post.Resources
+	c.lock.RLock()
+	message := c.renderCaption(post.Module, latest)
+	c.lock.RUnlock()
+	var keyboard *tb.ReplyMarkup
+	if len(post.Messages) == 1 {
+		keyboard = c.postKeyboard(post.URL, &post)
+	}
+	edit := func(text string, mode tb.ParseMode) error {
+		return c.TgBot.EditMessage(post.ChatID, post.Messages[0], isCaption, text, mode, keyboard)
+	}
+	var err error
+	switch {
+	case message.CaptionHTML != "" && textLength(message.CaptionHTML, true) <= limit:
+		err = edit(message.CaptionHTML, tb.ModeHTML)
+		if err != nil && isMarkupError(err) && textLength(message.Caption, false) <= limit {
+			err = edit(message.Caption, tb.ModeDefault)
+		}
+	case textLength(message.Caption, false) <= limit:
+		err = edit(message.Caption, tb.ModeDefault)
+	default:
+		log.Printf("Post #%d for %s edited upstream but it is too long, skip.", post.ID, c.ID)
+		return
+	}
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Unable to edit post #%d for %s. %s", post.ID, c.ID, err)
+		return
+	}
+	if err := postsOf(c.DB).UpdateField(&post, "Caption", latest.Caption); err != nil {
+		log.Println("Unable to update post", err)
+	}
+	log.Printf("Post #%d for %s edited.", post.ID, c.ID)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	tb "github.com/ihciah/telebot"
+)
+
+// Telebot only knows photo and video albums without parse mode, and videos without metadata,
+// these helpers call the Bot API directly.
+
+var apiClient = &http.Client{Timeout: 5 * time.Minute}
+
+type apiResponse struct {
+	Ok          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Errors are formatted like the ones of telebot, so classifySendError handles both
+func (r *apiResponse) err() error {
+	if r.Parameters.RetryAfter > 0 {
+		return fmt.Errorf("api error: %s (retry after %d)", r.Description, r.Parameters.RetryAfter)
+	}
+	return fmt.Errorf("api error: %s", r.Description)
+}
+
+// InputMedia is an item of a media group
+type InputMedia struct {
+	Type              string `json:"type"`
+	Media             string `json:"media"`
+	Caption           string `json:"caption,omitempty"`
+	ParseMode         string `json:"parse_mode,omitempty"`
+	Thumb             string `json:"thumb,omitempty"`
+	Width             int    `json:"width,omitempty"`
+	Height            int    `json:"height,omitempty"`
+	Duration          int    `json:"duration,omitempty"`
+	SupportsStreaming bool   `json:"supports_streaming,omitempty"`
+	file              tb.File
+	thumb             *tb.File
+}
+
+// apiCall posts params to the method, local files are sent as multipart form
+func apiCall(bot *tb.Bot, method string, params map[string]string, files map[string]string) (json.RawMessage, error) {
+	var respJSON []byte
+	var err error
+	if len(files) == 0 {
+		respJSON, err = bot.Raw(method, params)
+	} else {
+		respJSON, err = apiUpload(bot, method, params, files)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp apiResponse
+	if err := json.Unmarshal(respJSON, &resp); err != nil {
+		return nil, fmt.Errorf("bad response json: %s", err)
+	}
+	if !resp.Ok {
+		return nil, resp.err()
+	}
+	return resp.Result, nil
+}
+
+func apiUpload(bot *tb.Bot, method string, params map[string]string, files map[string]string) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, path := range files {
+		if err := func() error {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			part, err := writer.CreateFormFile(name, filepath.Base(path))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(part, file)
+			return err
+		}(); err != nil {
+			return nil, fmt.Errorf("system error: %s", err)
+		}
+	}
+	for field, value := range params {
+		_ = writer.WriteField(field, value)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("system error: %s", err)
+	}
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", bot.Token, method)
+	resp, err := apiClient.Post(url, writer.FormDataContentType(), body)
+	if err != nil {
+		return nil, fmt.Errorf("http.Post failed: %s", err)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// SendMediaGroup sends 2-10 items as an album
+func (t *TelegramBot) SendMediaGroup(to tb.Recipient, items []InputMedia) ([]tb.Message, error) {
+	files := make(map[string]string)
+	for i := range items {
+		media, ok := attachFile(items[i].file, "file"+strconv.Itoa(i), files)
+		if !ok {
+			return nil, fmt.Errorf("album entry #%d doesn't exist anywhere", i)
+		}
+		items[i].Media = media
+		if items[i].thumb != nil {
+			items[i].Thumb, _ = attachFile(*items[i].thumb, "thumb"+strconv.Itoa(i), files)
+		}
+	}
+	media, _ := json.Marshal(items)
+	params := map[string]string{
+		"chat_id": to.Recipient(),
+		"media":   string(media),
+	}
+
+	t.Scheduler.Wait(chatKey(to), len(items))
+	result, err := apiCall(t.Bot, "sendMediaGroup", params, files)
+	if err != nil {
+		return nil, err
+	}
+	var messages []tb.Message
+	if err := json.Unmarshal(result, &messages); err != nil {
+		return nil, fmt.Errorf("bad response json: %s", err)
+	}
+	return messages, nil
+}
+
+// EditMessage replaces the text of a message, or the caption of a media message, keeping the keyboard given
+func (t *TelegramBot) EditMessage(chatID int64, messageID int, isCaption bool, text string, mode tb.ParseMode,
+	keyboard *tb.ReplyMarkup) error {
+	method, field := "editMessageText", "text"
+	if isCaption {
+		method, field = "editMessageCaption", "caption"
+	}
+	params := map[string]string{
+		"chat_id":    strconv.FormatInt(chatID, 10),
+		"message_id": strconv.Itoa(messageID),
+		field:        text,
+	}
+	embedOptions(params, &tb.SendOptions{ParseMode: mode, ReplyMarkup: keyboard})
+	t.Scheduler.Wait(strconv.FormatInt(chatID, 10), 1)
+	_, err := apiCall(t.Bot, method, params, nil)
+	return err
+}
+
+// embedOptions adds the send options to params the way Telebot does for its own sends
+func embedOptions(params map[string]string, opt *tb.SendOptions) {
+	if opt == nil {
+		return
+	}
+	if opt.ReplyTo != nil && opt.ReplyTo.ID != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(opt.ReplyTo.ID)
+	}
+	if opt.DisableWebPagePreview {
+		params["disable_web_page_preview"] = "true"
+	}
+	if opt.DisableNotification {
+		params["disable_notification"] = "true"
+	}
+	if opt.ParseMode != tb.ModeDefault {
+		params["parse_mode"] = string(opt.ParseMode)
+	}
+	if opt.ReplyMarkup != nil {
+		params["reply_markup"] = markupJSON(opt.ReplyMarkup)
+	}
+}
+
+// markupJSON serializes a keyboard like Telebot, which routes callback buttons with a Unique
+// endpoint by their data. The keyboard is copied, as it may be shared by several sends.
+func markupJSON(keyboard *tb.ReplyMarkup) string {
+	markup := *keyboard
+	markup.InlineKeyboard = make([][]tb.InlineButton, 0, len(keyboard.InlineKeyboard))
+	for _, row := range keyboard.InlineKeyboard {
+		row = append([]tb.InlineButton{}, row...)
+		for i := range row {
+			if key := &row[i]; key.Unique != "" {
+				if key.Data == "" {
+					key.Data = "\f" + key.Unique
+				} else {
+					key.Data = "\f" + key.Unique + "|" + key.Data
+				}
+			}
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+	data, _ := json.Marshal(&markup)
+	return string(data)
+}
+
+// attachFile gives how the file is referred in a request, files on disk are added to files by name
+func attachFile(f tb.File, name string, files map[string]string) (string, bool) {
+	switch {
+	case f.InCloud():
+		return f.FileID, true
+	case f.FileURL != "":
+		return f.FileURL, true
+	case f.OnDisk():
+		files[name] = f.FileLocal
+		return "attach://" + name, true
+	}
+	return "", false
+}
+
+// VideoMessage is a video sent with its size, duration and thumbnail, which Telebot leaves out
+type VideoMessage struct {
+	tb.Video
+	Thumb             *tb.File // Only uploaded thumbnails are taken
+	SupportsStreaming bool
+}
+
+func (v *VideoMessage) Send(bot *tb.Bot, to tb.Recipient, opt *tb.SendOptions) (*tb.Message, error) {
+	files := make(map[string]string)
+	media, ok := attachFile(v.File, "video", files)
+	if !ok {
+		return nil, errors.New("video doesn't exist anywhere")
+	}
+	params := map[string]string{
+		"chat_id": to.Recipient(),
+		"video":   media,
+		"caption": v.Caption,
+	}
+	for name, value := range map[string]int{"width": v.Width, "height": v.Height, "duration": v.Duration} {
+		if value > 0 {
+			params[name] = strconv.Itoa(value)
+		}
+	}
+	if v.SupportsStreaming {
+		params["supports_streaming"] = "true"
+	}
+	if v.Thumb != nil {
+		if thumb, ok := attachFile(*v.Thumb, "thumb", files); ok {
+			params["thumb"] = thumb
+		}
+	}
+	embedOptions(params, opt)
+
+	result, err := apiCall(bot, "sendVideo", params, files)
+	if err != nil {
+		return nil, err
+	}
+	var msg tb.Message
+	if err := json.Unmarshal(result, &msg); err != nil {
+		return nil, fmt.Errorf("bad response json: %s", err)
+	}
+	return &msg, nil
+}
+
+// ForwardIndex keeps the ids of the messages copies forwarded to the bot came from, which
+// Telebot leaves out. Copies are keyed by chat and message id, the oldest half is dropped
+// when it is full.
+type ForwardIndex struct {
+	lock  sync.Mutex
+	ids   map[string]int
+	order []string
+}
+
+const MaxForwards = 1000
+
+func NewForwardIndex() *ForwardIndex {
+	return &ForwardIndex{ids: make(map[string]int)}
+}
+
+func forwardKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
+
+func (x *ForwardIndex) add(chatID int64, messageID int, original int) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	key := forwardKey(chatID, messageID)
+	if _, ok := x.ids[key]; !ok {
+		x.order = append(x.order, key)
+	}
+	x.ids[key] = original
+	if len(x.order) > MaxForwards {
+		for _, old := range x.order[:MaxForwards/2] {
+			delete(x.ids, old)
+		}
+		x.order = append([]string{}, x.order[MaxForwards/2:]...)
+	}
+}
+
+// Original gives the id of the message the copy was forwarded from
+func (x *ForwardIndex) Original(chatID int64, messageID int) (int, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	id, ok := x.ids[forwardKey(chatID, messageID)]
+	return id, ok
+}
+
+// forwardedMessage is the part of a message telling where it and the one it replies to came from
+type forwardedMessage struct {
+	ID   int `json:"message_id"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	ForwardID int `json:"forward_from_message_id"`
+	ReplyTo   *struct {
+		ID        int `json:"message_id"`
+		ForwardID int `json:"forward_from_message_id"`
+	} `json:"reply_to_message"`
+}
+
+// ForwardPoller is a long poller which records forwarded messages in the index before handlers run
+type ForwardPoller struct {
+	Timeout      time.Duration
+	Forwards     *ForwardIndex
+	LastUpdateID int
+}
+
+func (p *ForwardPoller) Poll(b *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	go func() {
+		<-stop
+		close(stop)
+	}()
+
+	for {
+		params := map[string]string{
+			"offset":  strconv.Itoa(p.LastUpdateID + 1),
+			"timeout": strconv.Itoa(int(p.Timeout / time.Second)),
+		}
+		result, err := apiCall(b, "getUpdates", params, nil)
+		var updates []json.RawMessage
+		if err == nil {
+			err = json.Unmarshal(result, &updates)
+		}
+		if err != nil {
+			log.Println("Unable to get updates", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, raw := range updates {
+			var update tb.Update
+			if err := json.Unmarshal(raw, &update); err != nil {
+				log.Println("Unable to parse update", err)
+				continue
+			}
+			p.LastUpdateID = update.ID
+			var forwarded struct {
+				Message *forwardedMessage `json:"message"`
+			}
+			if json.Unmarshal(raw, &forwarded) == nil && forwarded.Message != nil {
+				m := forwarded.Message
+				if m.ForwardID != 0 {
+					p.Forwards.add(m.Chat.ID, m.ID, m.ForwardID)
+				}
+				if m.ReplyTo != nil && m.ReplyTo.ForwardID != 0 {
+					p.Forwards.add(m.Chat.ID, m.ReplyTo.ID, m.ReplyTo.ForwardID)
+				}
+			}
+			dest <- update
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/asdine/storm"
@@ -16,6 +17,9 @@ import (
 
 const MaxAlbumSize = 10
 
+// Text of the message which carries the keyboard of a post ending with an album
+const AlbumKeyboardText = "⬆️"
+
 type TelegramBot struct {
 	Bot            *tb.Bot
 	Database       *storm.DB
@@ -25,6 +29,11 @@ type TelegramBot struct {
 	FetcherConfigs FetcherConfig `json:"fetcher_config"`
 	Channels       *[]*Channel
 	Admins         []string `json:"admins"`
+	TempDirPath    string   `json:"temp_dir"`
+	TempDirLimit   int64    `json:"temp_dir_limit"` // MB
+	Scheduler      *SendScheduler
+	Uploads        *TempDir
+	Forwards       *ForwardIndex
 }
 
 func (t *TelegramBot) LoadConfigFromEnv() {
@@ -35,34 +44,25 @@ func (t *TelegramBot) LoadConfigFromEnv() {
 	admin := []string{os.Getenv("ADMIN_NAME")}
 	t.Admins = admin
 
-	var tumblrFetcher f.TumblrFetcher
-	tumblrFetcher.OAuthConsumerKey = os.Getenv("TUMBLR_KEY")
-	tumblrFetcher.OAuthConsumerSecret = os.Getenv("TUMBLR_SECRET")
-	tumblrFetcher.OAuthToken = os.Getenv("TUMBLR_TOKEN")
-	tumblrFetcher.OAuthTokenSecret = os.Getenv("TUMBLR_TOKEN_SECRET")
-
-	var twitterFetcher f.TwitterFetcher
-	twitterFetcher.AccessTokenSecret = os.Getenv("TWITTER_TOKEN_SECRET")
-	twitterFetcher.AccessToken = os.Getenv("TWITTER_TOKEN")
-	twitterFetcher.ConsumerKey = os.Getenv("TWITTER_KEY")
-	twitterFetcher.ConsumerSecret = os.Getenv("TWITTER_SECRET")
-
-	var fetcherConfig FetcherConfig
-	fetcherConfig.Tumblr = tumblrFetcher
-	fetcherConfig.Twitter = twitterFetcher
-
-	t.FetcherConfigs = fetcherConfig
+	t.FetcherConfigs = make(FetcherConfig)
+	for _, module := range f.Modules() {
+		if config := module.ConfigFromEnv(os.Getenv); config != nil {
+			t.FetcherConfigs[module.Name] = config
+		}
+	}
 
 	var err error
+	t.Forwards = NewForwardIndex()
 	t.Bot, err = tb.NewBot(tb.Settings{
 		Token:       t.Token,
-		Poller:      &tb.LongPoller{Timeout: time.Duration(t.Timeout) * time.Second},
+		Poller:      &ForwardPoller{Timeout: time.Duration(t.Timeout) * time.Second, Forwards: t.Forwards},
 		HTTPTimeout: t.Timeout,
 	})
 	if err != nil {
 		log.Fatal("[Cannot initialize telegram Bot]", err)
 		return
 	}
+	t.initDelivery()
 
 	t.Database, err = storm.Open(t.DatabasePath, storm.BoltOptions(0600, &bolt.Options{Timeout: 5 * time.Second}))
 	if err != nil {
@@ -81,15 +81,17 @@ func (t *TelegramBot) LoadConfig(json_path string) {
 		log.Fatal("[Cannot parse telegram config]", err)
 		return
 	}
+	t.Forwards = NewForwardIndex()
 	t.Bot, err = tb.NewBot(tb.Settings{
 		Token:       t.Token,
-		Poller:      &tb.LongPoller{Timeout: time.Duration(t.Timeout) * time.Second},
+		Poller:      &ForwardPoller{Timeout: time.Duration(t.Timeout) * time.Second, Forwards: t.Forwards},
 		HTTPTimeout: t.Timeout,
 	})
 	if err != nil {
 		log.Fatal("[Cannot initialize telegram Bot]", err)
 		return
 	}
+	t.initDelivery()
 
 	t.Database, err = storm.Open(t.DatabasePath, storm.BoltOptions(0600, &bolt.Options{Timeout: 5 * time.Second}))
 	if err != nil {
@@ -98,79 +100,275 @@ func (t *TelegramBot) LoadConfig(json_path string) {
 	log.Printf("[Bot initialized]Token: %s\nTimeout: %d\n", t.Token, t.Timeout)
 }
 
+func (t *TelegramBot) initDelivery() {
+	var err error
+	t.Scheduler = NewSendScheduler()
+	t.Uploads, err = NewTempDir(t.TempDirPath, t.TempDirLimit)
+	if err != nil {
+		log.Fatal("[Cannot initialize temp dir]", err)
+	}
+}
+
 func (t *TelegramBot) Serve() {
 	t.RegisterHandler()
 	t.Bot.Start()
 }
 
 func (t *TelegramBot) Send(to tb.Recipient, message f.ReplyMessage) error {
-	if message.Err != nil {
-		return message.Err
-	}
-
-	if len(message.Resources) == 1 {
-		var err error
-		var mediaFile tb.InputMedia
-		if message.Resources[0].T == f.TIMAGE {
-			mediaFile = &tb.Photo{File: tb.FromURL(message.Resources[0].URL), Caption: message.Caption}
-		} else if message.Resources[0].T == f.TVIDEO {
-			mediaFile = &tb.Video{File: tb.FromURL(message.Resources[0].URL), Caption: message.Caption}
-		} else {
-			return errors.New("Undefined message type.")
+	_, _, err := t.Deliver(to, -1, message, nil, 0)
+	return err
+}
+
+// Resource types which may be mixed in one album
+const (
+	albumNone = iota
+	albumVisual
+	albumDocument
+	albumAudio
+)
+
+func albumKind(r f.Resource) int {
+	switch r.T {
+	case f.TIMAGE, f.TVIDEO:
+		return albumVisual
+	case f.TDOCUMENT:
+		return albumDocument
+	case f.TAUDIO:
+		return albumAudio
+	}
+	return albumNone
+}
+
+// planAlbums splits resources into sends in their original order. Consecutive resources
+// which may share an album are grouped, and groups larger than MaxAlbumSize are split
+// into chunks of similar size. A chunk of one resource is sent as a single media.
+func planAlbums(resources []f.Resource) [][]f.Resource {
+	plan := make([][]f.Resource, 0, len(resources)/MaxAlbumSize+1)
+	for start := 0; start < len(resources); {
+		kind := albumKind(resources[start])
+		end := start + 1
+		for end < len(resources) && albumKind(resources[end]) == kind {
+			end++
+		}
+		if kind == albumNone {
+			log.Printf("Skip %d resource(s) of undefined type.", end-start)
+			start = end
+			continue
+		}
+
+		run := resources[start:end]
+		chunks := (len(run) + MaxAlbumSize - 1) / MaxAlbumSize
+		for i, offset := 0, 0; i < chunks; i++ {
+			size := len(run) / chunks
+			if i < len(run)%chunks {
+				size++
+			}
+			plan = append(plan, run[offset:offset+size])
+			offset += size
 		}
-		_, err = t.Bot.Send(to, mediaFile)
-		return err
+		start = end
 	}
+	return plan
+}
 
-	if len(message.Resources) == 0 {
-		if _, err := t.Bot.Send(to, message.Caption); err != nil {
-			log.Println("Unable to send text:", message.Caption)
-			return err
-		} else {
-			log.Println("Sent text:", message.Caption)
+func endsWithAlbum(plan [][]f.Resource) bool {
+	return len(plan) != 0 && len(plan[len(plan)-1]) > 1
+}
+
+// keyboardMessage tells whether the keyboard of the message goes on a message of its own,
+// which is when the message ends with an album and its caption fits
+func keyboardMessage(message f.ReplyMessage, keyboard *tb.ReplyMarkup) bool {
+	if keyboard == nil || !endsWithAlbum(planAlbums(message.Resources)) {
+		return false
+	}
+	caption, isHTML := message.CaptionHTML, true
+	if caption == "" {
+		caption, isHTML = message.Caption, false
+	}
+	_, more := cutText(caption, isHTML, MaxCaptionLength)
+	return isBlank(more, isHTML)
+}
+
+// thumbnail gives the downloaded thumbnail of a video, Telegram takes none by URL
+func thumbnail(r f.Resource, file func(f.Resource) tb.File) *tb.File {
+	if r.Thumbnail == "" {
+		return nil
+	}
+	if thumb := file(f.Resource{URL: r.Thumbnail}); thumb.OnDisk() {
+		return &thumb
+	}
+	return nil
+}
+
+func inputMedia(r f.Resource, file func(f.Resource) tb.File, caption string, mode tb.ParseMode) InputMedia {
+	media := InputMedia{Caption: caption, ParseMode: string(mode), file: file(r)}
+	switch r.T {
+	case f.TIMAGE:
+		media.Type = "photo"
+	case f.TVIDEO:
+		media.Type = "video"
+		media.Width, media.Height, media.Duration = r.Width, r.Height, r.Duration
+		media.SupportsStreaming = true
+		media.thumb = thumbnail(r, file)
+	case f.TDOCUMENT:
+		media.Type = "document"
+	case f.TAUDIO:
+		media.Type = "audio"
+	}
+	return media
+}
+
+func sendable(r f.Resource, file func(f.Resource) tb.File, caption string) interface{} {
+	switch r.T {
+	case f.TIMAGE:
+		return &tb.Photo{File: file(r), Caption: caption}
+	case f.TVIDEO:
+		return &VideoMessage{
+			Video:             tb.Video{File: file(r), Width: r.Width, Height: r.Height, Duration: r.Duration, Caption: caption},
+			Thumb:             thumbnail(r, file),
+			SupportsStreaming: true,
+		}
+	case f.TDOCUMENT:
+		return &tb.Document{File: file(r), Caption: caption}
+	case f.TAUDIO:
+		return &tb.Audio{File: file(r), Duration: r.Duration, Caption: caption}
+	}
+	return nil
+}
+
+// isMarkupError tells whether Telegram rejected the HTML of a caption
+func isMarkupError(err error) bool {
+	return strings.Contains(err.Error(), "can't parse entities")
+}
+
+// messageSender sends messages and albums to Telegram, it is the bot but in tests
+type messageSender interface {
+	BotSend(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error)
+	SendMediaGroup(to tb.Recipient, items []InputMedia) ([]tb.Message, error)
+}
+
+// sendMessage sends the message with files of resources given by file, starting from the
+// part from, and returns the ids of messages sent and the number of parts done. Parts are
+// the albums or single media of the message, then the parts of its text. The HTML caption
+// is preferred, and the plain one is sent from the failed part if Telegram is unable to parse it.
+func sendMessage(s messageSender, to tb.Recipient, message f.ReplyMessage, keyboard *tb.ReplyMarkup,
+	file func(f.Resource) tb.File, from int) ([]int, int, error) {
+	if message.CaptionHTML == "" {
+		return sendCaption(s, to, message, keyboard, file, message.Caption, tb.ModeDefault, from)
+	}
+	sent, done, err := sendCaption(s, to, message, keyboard, file, message.CaptionHTML, tb.ModeHTML, from)
+	if err != nil && isMarkupError(err) {
+		log.Println("Unable to send HTML caption, fallback to plain text.", err)
+		more, done, err := sendCaption(s, to, message, keyboard, file, message.Caption, tb.ModeDefault, done)
+		return append(sent, more...), done, err
+	}
+	return sent, done, err
+}
+
+// sendText sends text in parts within the length limit of Telegram starting from the part
+// from, the keyboard goes with the last part
+func sendText(s messageSender, to tb.Recipient, text string, mode tb.ParseMode, keyboard *tb.ReplyMarkup, from int) ([]int, int, error) {
+	parts := splitText(text, mode == tb.ModeHTML, MaxTextLength)
+	sent := make([]int, 0, len(parts))
+	for i, part := range parts {
+		if i < from {
+			continue
 		}
+		options := &tb.SendOptions{ParseMode: mode}
+		if i == len(parts)-1 {
+			options.ReplyMarkup = keyboard
+		}
+		msg, err := s.BotSend(to, part, options)
+		if err != nil {
+			log.Println("Unable to send text:", part)
+			return sent, i, err
+		}
+		sent = append(sent, msg.ID)
+		log.Println("Sent text:", part)
+	}
+	return sent, len(parts), nil
+}
+
+// sendCaption sends the resources of message with the caption in the parse mode.
+// The caption is attached once, to the first item of the first album, and the part
+// over the caption limit follows the media as text. The keyboard goes with the last
+// message, or with a short message after the last album which can't carry one.
+// Parts before from are skipped.
+func sendCaption(s messageSender, to tb.Recipient, message f.ReplyMessage, keyboard *tb.ReplyMarkup,
+	file func(f.Resource) tb.File, caption string, mode tb.ParseMode, from int) ([]int, int, error) {
+	if len(message.Resources) == 0 {
+		return sendText(s, to, caption, mode, keyboard, from)
 	}
 
-	var ret error
-	for i := 0; i < len(message.Resources); i += MaxAlbumSize {
-		end := i + MaxAlbumSize
-		if end > len(message.Resources) {
-			end = len(message.Resources)
+	caption, more := cutText(caption, mode == tb.ModeHTML, MaxCaptionLength)
+	moreText := !isBlank(more, mode == tb.ModeHTML)
+	plan := planAlbums(message.Resources)
+	if len(plan) == 0 {
+		return nil, from, errors.New("Undefined message type.")
+	}
+	if !moreText && keyboard != nil && endsWithAlbum(plan) {
+		more, moreText = AlbumKeyboardText, true
+	}
+	sent := make([]int, 0, len(message.Resources)+1)
+	for i, album := range plan {
+		if i != 0 {
+			caption = ""
 		}
-		mediaFiles := make(tb.Album, 0, MaxAlbumSize)
-		for idx, r := range message.Resources[i : end-1] {
-			if idx != end {
-				if r.T == f.TIMAGE {
-					mediaFiles = append(mediaFiles, &tb.Photo{File: tb.FromURL(r.URL)})
-				} else if r.T == f.TVIDEO {
-					mediaFiles = append(mediaFiles, &tb.Video{File: tb.FromURL(r.URL)})
-				} else {
-					continue
-				}
+		if i < from {
+			continue
+		}
+		if len(album) == 1 {
+			options := &tb.SendOptions{ParseMode: mode}
+			if i == len(plan)-1 && !moreText {
+				options.ReplyMarkup = keyboard
+			}
+			msg, err := s.BotSend(to, sendable(album[0], file, caption), options)
+			if err != nil {
+				log.Println("Unable to send media", err)
+				return sent, i, err
 			}
+			sent = append(sent, msg.ID)
+			continue
+		}
 
-			if r.T == f.TIMAGE {
-				mediaFiles = append(mediaFiles, &tb.Photo{File: tb.FromURL(r.URL), Caption: message.Caption})
-			} else if r.T == f.TVIDEO {
-				mediaFiles = append(mediaFiles, &tb.Video{File: tb.FromURL(r.URL), Caption: message.Caption})
-			} else {
-				continue
+		items := make([]InputMedia, 0, len(album))
+		for j, r := range album {
+			if j != 0 {
+				caption = ""
 			}
+			items = append(items, inputMedia(r, file, caption, mode))
 		}
-		if _, err := t.Bot.SendAlbum(to, mediaFiles); err != nil {
+		msgs, err := s.SendMediaGroup(to, items)
+		if err != nil {
 			log.Println("Unable to send album", err)
-			ret = err
-		} else {
-			log.Println("Sent album")
+			return sent, i, err
+		}
+		for _, msg := range msgs {
+			sent = append(sent, msg.ID)
 		}
+		log.Printf("Sent album of %d", len(items))
 	}
-	return ret
+	textFrom := from - len(plan)
+	if textFrom < 0 {
+		textFrom = 0
+	}
+	texts, done, err := sendText(s, to, more, mode, keyboard, textFrom)
+	return append(sent, texts...), len(plan) + done, err
 }
 
+// SendAll sends messages one by one to keep their order
 func (t *TelegramBot) SendAll(to tb.Recipient, messages []f.ReplyMessage) (err error) {
 	err = nil
 	for _, msg := range messages {
-		go t.Send(to, msg)
+		if e := t.Send(to, msg); e != nil {
+			err = e
+		}
 	}
 	return
 }
+
+// BotSend is Bot.Send throttled by the send scheduler
+func (t *TelegramBot) BotSend(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error) {
+	t.Scheduler.Wait(chatKey(to), 1)
+	return t.Bot.Send(to, what, options...)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+	tb "github.com/ihciah/telebot"
+)
+
+// sentMessage is what a fake sender got in one request, an album has several types
+type sentMessage struct {
+	Types    []string
+	Captions []string
+	Keyboard bool
+}
+
+type fakeSender struct {
+	sent   []sentMessage
+	lastID int
+}
+
+func (s *fakeSender) BotSend(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error) {
+	m := sentMessage{}
+	switch v := what.(type) {
+	case string:
+		m.Types, m.Captions = []string{"text"}, []string{v}
+	case *tb.Photo:
+		m.Types, m.Captions = []string{"photo"}, []string{v.Caption}
+	case *VideoMessage:
+		m.Types, m.Captions = []string{"video"}, []string{v.Caption}
+	case *tb.Document:
+		m.Types, m.Captions = []string{"document"}, []string{v.Caption}
+	case *tb.Audio:
+		m.Types, m.Captions = []string{"audio"}, []string{v.Caption}
+	}
+	for _, o := range options {
+		if o, ok := o.(*tb.SendOptions); ok && o.ReplyMarkup != nil {
+			m.Keyboard = true
+		}
+	}
+	s.sent = append(s.sent, m)
+	s.lastID++
+	return &tb.Message{ID: s.lastID}, nil
+}
+
+func (s *fakeSender) SendMediaGroup(to tb.Recipient, items []InputMedia) ([]tb.Message, error) {
+	m := sentMessage{}
+	msgs := make([]tb.Message, 0, len(items))
+	for _, item := range items {
+		m.Types = append(m.Types, item.Type)
+		m.Captions = append(m.Captions, item.Caption)
+		s.lastID++
+		msgs = append(msgs, tb.Message{ID: s.lastID})
+	}
+	s.sent = append(s.sent, m)
+	return msgs, nil
+}
+
+func resources(types ...int) []f.Resource {
+	res := make([]f.Resource, 0, len(types))
+	for i, t := range types {
+		res = append(res, f.Resource{URL: "https://example.com/" + string(rune('a'+i)), T: t})
+	}
+	return res
+}
+
+func repeat(t int, n int) []int {
+	types := make([]int, n)
+	for i := range types {
+		types[i] = t
+	}
+	return types
+}
+
+// media is a send of the types given, the caption goes with the first item
+func media(caption string, types ...string) sentMessage {
+	captions := make([]string, len(types))
+	captions[0] = caption
+	return sentMessage{Types: types, Captions: captions}
+}
+
+func text(s string, keyboard bool) sentMessage {
+	return sentMessage{Types: []string{"text"}, Captions: []string{s}, Keyboard: keyboard}
+}
+
+func TestPlanAlbums(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []int
+		want  []int
+	}{
+		{"one photo", []int{f.TIMAGE}, []int{1}},
+		{"full album", repeat(f.TIMAGE, 10), []int{10}},
+		{"11 photos", repeat(f.TIMAGE, 11), []int{6, 5}},
+		{"21 photos", repeat(f.TIMAGE, 21), []int{7, 7, 7}},
+		{"kinds apart", []int{f.TIMAGE, f.TVIDEO, f.TDOCUMENT, f.TAUDIO, f.TAUDIO}, []int{2, 1, 2}},
+		{"undefined skipped", []int{f.TIMAGE, -1, f.TIMAGE}, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		var sizes []int
+		for _, album := range planAlbums(resources(tt.types...)) {
+			sizes = append(sizes, len(album))
+		}
+		if !reflect.DeepEqual(sizes, tt.want) {
+			t.Errorf("%s: got albums of %v, want %v", tt.name, sizes, tt.want)
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	long := strings.Repeat("word ", 300)
+	head, more := cutText(long, false, MaxCaptionLength)
+	head, more = strings.TrimSpace(head), strings.TrimSpace(more)
+	photos := func(n int) []string { return strings.Split(strings.Repeat("photo,", n-1)+"photo", ",") }
+	tests := []struct {
+		name     string
+		types    []int
+		caption  string
+		keyboard bool
+		from     int
+		want     []sentMessage
+		done     int
+	}{
+		{
+			name:    "11 photos",
+			types:   repeat(f.TIMAGE, 11),
+			caption: "caption",
+			want:    []sentMessage{media("caption", photos(6)...), media("", photos(5)...)},
+			done:    2,
+		},
+		{
+			name:    "mixed runs",
+			types:   []int{f.TIMAGE, f.TVIDEO, f.TIMAGE, f.TDOCUMENT, f.TDOCUMENT, f.TAUDIO, f.TVIDEO},
+			caption: "caption",
+			want: []sentMessage{
+				media("caption", "photo", "video", "photo"),
+				media("", "document", "document"),
+				media("", "audio"),
+				media("", "video"),
+			},
+			done: 4,
+		},
+		{
+			name:    "single media first",
+			types:   []int{f.TDOCUMENT, f.TIMAGE, f.TIMAGE},
+			caption: "caption",
+			want:    []sentMessage{media("caption", "document"), media("", "photo", "photo")},
+			done:    2,
+		},
+		{
+			name:    "overflow text",
+			types:   repeat(f.TIMAGE, 12),
+			caption: long,
+			want:    []sentMessage{media(head, photos(6)...), media("", photos(6)...), text(more, false)},
+			done:    3,
+		},
+		{
+			name:     "keyboard after album",
+			types:    repeat(f.TIMAGE, 2),
+			caption:  "caption",
+			keyboard: true,
+			want:     []sentMessage{media("caption", photos(2)...), text(AlbumKeyboardText, true)},
+			done:     2,
+		},
+		{
+			name:     "keyboard on single media",
+			types:    []int{f.TIMAGE, f.TIMAGE, f.TAUDIO},
+			caption:  "caption",
+			keyboard: true,
+			want: []sentMessage{
+				media("caption", photos(2)...),
+				{Types: []string{"audio"}, Captions: []string{""}, Keyboard: true},
+			},
+			done: 2,
+		},
+		{
+			name:    "text only",
+			caption: "caption",
+			want:    []sentMessage{text("caption", false)},
+			done:    1,
+		},
+		{
+			name:    "resume",
+			types:   append(repeat(f.TIMAGE, 11), f.TAUDIO),
+			caption: long,
+			from:    1,
+			want:    []sentMessage{media("", photos(5)...), media("", "audio"), text(more, false)},
+			done:    4,
+		},
+	}
+	for _, tt := range tests {
+		s := &fakeSender{}
+		var keyboard *tb.ReplyMarkup
+		if tt.keyboard {
+			keyboard = &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{{Text: "button"}}}}
+		}
+		message := f.ReplyMessage{Resources: resources(tt.types...), Caption: tt.caption}
+		file := func(r f.Resource) tb.File { return tb.FromURL(r.URL) }
+		ids, done, err := sendMessage(s, &tb.Chat{ID: 1}, message, keyboard, file, tt.from)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		for i := range s.sent {
+			s.sent[i].Captions = trimAll(s.sent[i].Captions)
+		}
+		if !reflect.DeepEqual(s.sent, tt.want) {
+			t.Errorf("%s: sent %+v, want %+v", tt.name, s.sent, tt.want)
+		}
+		if done != tt.done || len(ids) != s.lastID {
+			t.Errorf("%s: got %d parts and %d ids, want %d parts and %d ids", tt.name, done, len(ids), tt.done, s.lastID)
+		}
+	}
+}
+
+func trimAll(captions []string) []string {
+	for i := range captions {
+		captions[i] = strings.TrimSpace(captions[i])
+	}
+	return captions
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"log"
 	"strconv"
 	"strings"
 
@@ -12,24 +14,17 @@ const AboutMessage = "This is a Bot designed for syncing message(text/image/vide
 	"from given sites to telegram channel/user/group by @ihciah.\n" +
 	"Check https://github.com/ihciah/tg_channel_bot for source code and other information.\n"
 
-type FetcherConfig struct {
-	Base    f.BaseFetcher
-	Twitter f.TwitterFetcher `json:"twitter"`
-	Tumblr  f.TumblrFetcher  `json:"tumblr"`
-	V2EX    f.V2EXFetcher
-}
+// Config sections of fetchers, keyed by module name
+type FetcherConfig map[string]json.RawMessage
 
 func (t *TelegramBot) CreateModule(moduleId int, channelId string) f.Fetcher {
-	var fetcher f.Fetcher
-	switch moduleId {
-	case MTwitter:
-		fetcher = &t.FetcherConfigs.Twitter
-	case MTumblr:
-		fetcher = &t.FetcherConfigs.Tumblr
-	case MV2EX:
-		fetcher = &t.FetcherConfigs.V2EX
-	default:
-		fetcher = &t.FetcherConfigs.Base
+	var fetcher f.Fetcher = new(f.BaseFetcher)
+	if module, ok := f.ModuleByID(moduleId); ok {
+		if created, err := module.Create(t.FetcherConfigs[module.Name]); err != nil {
+			log.Printf("Unable to load config of module %s. %s", module.Name, err)
+		} else {
+			fetcher = created
+		}
 	}
 	_ = fetcher.Init(t.Database, channelId)
 	return fetcher
@@ -42,40 +37,41 @@ func (t *TelegramBot) RegisterHandler() {
 	// TgBot.Bot.Handle("/v2ex", TgBot.handle_v2ex)
 	t.Bot.Handle(tb.OnText, t.handleController)
 	t.Bot.Handle(tb.OnPhoto, t.handlePhoto)
+	t.Bot.Handle(tb.OnCallback, t.handleCallback)
+	t.Bot.Handle(tb.OnChannelPost, t.handleChannelPost)
 }
 
+// handlePhoto blocks the media of a post forwarded from a channel to the bot
 func (t *TelegramBot) handlePhoto(m *tb.Message) {
-	chatID := strconv.FormatInt(m.OriginalChat.ID, 10)
-	if m.OriginalChat.Type == "channel" {
-		chatID = "@" + m.OriginalChat.Username
+	if m.OriginalChat == nil || m.Chat.Type != tb.ChatPrivate {
+		return
 	}
+	_, _ = t.BotSend(m.Sender, t.onPost(m.Sender, m.Chat, m, replyBlock, []string{replyBlock}))
+}
 
-	pass := false
-	for _, v := range *t.Channels {
-		if v.ID == chatID && authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
-			pass = true
-			break
-		}
-	}
-	if !pass {
-		_, _ = t.Bot.Send(m.Sender, "Unauthorized.")
+// handleChannelPost runs commands replied to posts in channels, the command post is removed after.
+// The source asked by whence is replied to the post, the result of block is only logged.
+func (t *TelegramBot) handleChannelPost(m *tb.Message) {
+	cmd := replyCommand(m)
+	if cmd == "" {
 		return
 	}
-
-	var fetcher f.Fetcher
-	if strings.Contains(m.Caption, "tumblr") {
-		fetcher = new(f.TumblrFetcher)
+	result := t.handleReply(m)
+	log.Printf("Reply %s in %d: %s", cmd, m.Chat.ID, result)
+	if cmd == replyWhence {
+		_, _ = t.BotSend(m.Chat, result, &tb.SendOptions{ReplyTo: m.ReplyTo})
+	}
+	if err := t.Bot.Delete(m); err != nil {
+		log.Println("Unable to delete reply", err)
 	}
-	_ = fetcher.Init(t.Database, chatID)
-	_, _ = t.Bot.Send(m.Sender, fetcher.Block(m.Caption))
 }
 
 func (t *TelegramBot) handleAbout(m *tb.Message) {
-	_, _ = t.Bot.Send(m.Sender, AboutMessage)
+	_, _ = t.BotSend(m.Sender, AboutMessage)
 }
 
 func (t *TelegramBot) handleId(m *tb.Message) {
-	_, _ = t.Bot.Send(m.Chat, t.hGetId([]string{}, m))
+	_, _ = t.BotSend(m.Chat, t.hGetId([]string{}, m))
 }
 
 func (t *TelegramBot) handleExampleFetcherExample(m *tb.Message) {
@@ -91,19 +87,38 @@ func (t *TelegramBot) handleV2ex(m *tb.Message) {
 }
 
 func (t *TelegramBot) handleController(m *tb.Message) {
+	if replyCommand(m) != "" {
+		_ = t.Send(m.Chat, f.ReplyMessage{Caption: t.handleReply(m)})
+		return
+	}
 	handlers := map[string]func([]string, *tb.Message) string{
-		"addchannel":  t.requireSuperAdmin(t.hAddChannel),
-		"delchannel":  t.requireSuperAdmin(t.hDelChannel),
-		"listchannel": t.requireSuperAdmin(t.hListChannel),
-		"addfollow":   t.hAddFollow,
-		"delfollow":   t.hDelFollow,
-		"listfollow":  t.hListFollow,
-		"addadmin":    t.requireSuperAdmin(t.hAddAdmin),
-		"deladmin":    t.requireSuperAdmin(t.hDelAdmin),
-		"listadmin":   t.requireSuperAdmin(t.hListAdmin),
-		"setinterval": t.hSetInterval,
-		"goback":      t.hGoBack,
-		"id":          t.hGetId,
+		"addchannel":      t.requireSuperAdmin(t.hAddChannel),
+		"delchannel":      t.requireSuperAdmin(t.hDelChannel),
+		"listchannel":     t.requireSuperAdmin(t.hListChannel),
+		"addfollow":       t.hAddFollow,
+		"delfollow":       t.hDelFollow,
+		"listfollow":      t.hListFollow,
+		"addadmin":        t.requireSuperAdmin(t.hAddAdmin),
+		"deladmin":        t.requireSuperAdmin(t.hDelAdmin),
+		"listadmin":       t.requireSuperAdmin(t.hListAdmin),
+		"setinterval":     t.hSetInterval,
+		"goback":          t.hGoBack,
+		"queue":           t.hQueue,
+		"purgequeue":      t.hPurgeQueue,
+		"listdead":        t.hListDead,
+		"resenddead":      t.hResendDead,
+		"purgedead":       t.hPurgeDead,
+		"settemplate":     t.hSetTemplate,
+		"gettemplate":     t.hGetTemplate,
+		"previewtemplate": t.hPreviewTemplate,
+		"setbuttons":      t.hSetButtons,
+		"addfilter":       t.hAddFilter,
+		"delfilter":       t.hDelFilter,
+		"listfilter":      t.hListFilter,
+		"testfilter":      t.hTestFilter,
+		"setsync":         t.hSetSync,
+		"setoption":       t.hSetOption,
+		"id":              t.hGetId,
 	}
 
 	var cmd string
@@ -3,12 +3,17 @@ package main
 import (
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	tb "github.com/ihciah/telebot"
 )
 
+// Command and channel id, followed by the rest of the text
+var templateArgRegex = regexp.MustCompile(`^\s*\S+\s+\S+\s*`)
+
 func (t *TelegramBot) hAddChannel(p []string, m *tb.Message) string {
 	if len(p) != 1 {
 		return "Usage: addchannel @channel_id/chat_id"
@@ -48,9 +53,13 @@ func (t *TelegramBot) hDelFollow(p []string, m *tb.Message) string {
 }
 
 func (t *TelegramBot) hUser(p []string, m *tb.Message, isAdd bool) string {
-	if len(p) != 3 {
-		return "Usage: addfollow/delfollow @channel_id/chat_id site(twitter/tumblr) userid"
+	if len(p) < 3 {
+		return fmt.Sprintf("Usage: addfollow/delfollow @channel_id/chat_id site(%s) userid/feed_url\n"+
+			"Twitter also follows list:id, list:owner/slug, search:query, likes:userid and #hashtag",
+			strings.Join(MakeModuleLabeler().Names(), "/"))
 	}
+	// Search queries may contain spaces
+	following := strings.Join(p[2:], " ")
 	for _, v := range *t.Channels {
 		if v.ID == p[0] {
 			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
@@ -61,10 +70,10 @@ func (t *TelegramBot) hUser(p []string, m *tb.Message, isAdd bool) string {
 				return "Unsupported site."
 			}
 			if isAdd {
-				v.AddFollowing(ModuleUser{module, p[2]})
+				v.AddFollowing(ModuleUser{module, following})
 				return "Following added."
 			} else {
-				v.DelFollowing(ModuleUser{module, p[2]})
+				v.DelFollowing(ModuleUser{module, following})
 				return "Following deleted."
 			}
 		}
@@ -122,6 +131,8 @@ func (t *TelegramBot) hListFollow(p []string, m *tb.Message) string {
 			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
 				return "Unauthorized."
 			}
+			v.lock.RLock()
+			defer v.lock.RUnlock()
 			ret := make([]string, 0, len(*t.Channels))
 			for moduleId, names := range *v.Followings {
 				ret = append(ret, fmt.Sprintf("Module: %s\nUpdateInterval: %d\nFollowings:\n%s", MakeModuleLabeler().Module2Str(moduleId), (*v.PushIntervals)[moduleId], strings.Join(names, "\n")))
@@ -168,12 +179,12 @@ func (t *TelegramBot) hListChannel(p []string, m *tb.Message) string {
 }
 
 func (t *TelegramBot) hGoBack(p []string, m *tb.Message) string {
-	if len(p) != 3 {
-		return "Usage: goback @channel_id/chat_id site N(second), N=0 means reset to Now."
+	if len(p) < 3 {
+		return "Usage: goback @channel_id/chat_id site N(second) [userid], N=0 means reset to Now."
 	}
 	back, err := strconv.ParseInt(p[2], 10, 64)
 	if err != nil || back < 0 {
-		return "Usage: goback @Channel/chat_id site N(second), N >= 0"
+		return "Usage: goback @Channel/chat_id site N(second) [userid], N >= 0"
 	}
 	for _, v := range *t.Channels {
 		if v.ID == p[0] {
@@ -184,16 +195,394 @@ func (t *TelegramBot) hGoBack(p []string, m *tb.Message) string {
 			if moduleId < 0 {
 				return "Unsupported site."
 			}
+			v.lock.RLock()
+			followings := append([]string{}, (*v.Followings)[moduleId]...)
+			v.lock.RUnlock()
+			if len(p) > 3 {
+				// Search queries may contain spaces
+				following, all := strings.Join(p[3:], " "), followings
+				followings = []string{}
+				for _, u := range all {
+					if u == following {
+						followings = append(followings, u)
+					}
+				}
+				if len(followings) == 0 {
+					return "No such following."
+				}
+			}
 			fetcher := t.CreateModule(moduleId, v.ID)
-			if err := fetcher.GoBack(v.ID, back); err != nil {
+			if err := fetcher.GoBack(v.ID, followings, back); err != nil {
 				return fmt.Sprintf("Error when go back. %s", err)
 			}
-			return fmt.Sprintf("Site %s for channel/chat %s has been set to %d seconds before.", p[1], v.ID, back)
+			return fmt.Sprintf("Site %s for channel/chat %s (%s) has been set to %d seconds before.",
+				p[1], v.ID, strings.Join(followings, ","), back)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hQueue(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: queue @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			size := v.OutboxSize()
+			if size == 0 {
+				return "No pending messages."
+			}
+			ret := make([]string, 0, 6)
+			ret = append(ret, fmt.Sprintf("Pending messages for %s: %d", v.ID, size))
+			for _, e := range v.PeekOutbox(5) {
+				ret = append(ret, fmt.Sprintf("#%d %s %s, %d resource(s): %s", e.ID,
+					time.Unix(e.Created, 0).Format("2006-01-02 15:04:05"), MakeModuleLabeler().Module2Str(e.Module),
+					len(e.Message.Resources), e.Message.Caption))
+			}
+			return strings.Join(ret, "\n")
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hPurgeQueue(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: purgequeue @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			size := v.OutboxSize()
+			if err := v.PurgeOutbox(); err != nil {
+				return fmt.Sprintf("Error when purge queue. %s", err)
+			}
+			return fmt.Sprintf("%d pending message(s) purged.", size)
 		}
 	}
 	return "No such channel/chat"
 }
 
+func (t *TelegramBot) hListDead(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: listdead @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			entries := v.ListDeadLetter()
+			if len(entries) == 0 {
+				return "No dead messages."
+			}
+			ret := make([]string, 0, len(entries)+1)
+			ret = append(ret, fmt.Sprintf("Dead messages for %s: %d", v.ID, len(entries)))
+			for _, e := range entries {
+				ret = append(ret, fmt.Sprintf("#%d %s, %d attempt(s): %s\n%s", e.ID,
+					MakeModuleLabeler().Module2Str(e.Module), e.Attempts, e.LastError, e.Message.Caption))
+			}
+			return strings.Join(ret, "\n\n")
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hResendDead(p []string, m *tb.Message) string {
+	if len(p) != 2 {
+		return "Usage: resenddead @channel_id/chat_id ID/all"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			entries := v.ListDeadLetter()
+			if p[1] != "all" {
+				id, err := strconv.ParseUint(strings.TrimPrefix(p[1], "#"), 10, 64)
+				if err != nil {
+					return "Usage: resenddead @channel_id/chat_id ID/all"
+				}
+				selected := make([]OutboxEntry, 0, 1)
+				for _, e := range entries {
+					if e.ID == id {
+						selected = append(selected, e)
+					}
+				}
+				entries = selected
+			}
+			if len(entries) == 0 {
+				return "No such dead message."
+			}
+			return fmt.Sprintf("%d message(s) queued again.", v.Resend(entries))
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hPurgeDead(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: purgedead @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			if err := v.PurgeDeadLetter(); err != nil {
+				return fmt.Sprintf("Error when purge dead messages. %s", err)
+			}
+			return "Dead messages purged."
+		}
+	}
+	return "No such channel/chat"
+}
+
+// templateArg takes the template from the raw text of command, as splitting on spaces loses them
+func templateArg(m *tb.Message) string {
+	match := templateArgRegex.FindStringIndex(m.Text)
+	if match == nil {
+		return ""
+	}
+	return captionEscapes.Replace(m.Text[match[1]:])
+}
+
+// templateSite is the site name used in template previews of the channel
+func templateSite(c *Channel) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	labeler := MakeModuleLabeler()
+	for _, name := range labeler.Names() {
+		if _, ok := (*c.Followings)[labeler.Str2Module(name)]; ok {
+			return name
+		}
+	}
+	if names := labeler.Names(); len(names) != 0 {
+		return names[0]
+	}
+	return ""
+}
+
+func (t *TelegramBot) hSetTemplate(p []string, m *tb.Message) string {
+	if len(p) < 1 {
+		return "Usage: settemplate @channel_id/chat_id [template], e.g. {{.Author}}: {{.Text}}\\n{{.URL}}\n" +
+			"Fields: .ID .Author .AuthorName .URL .Time .Site .Tags .Text, an empty template restores the default caption."
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			text := templateArg(m)
+			if text == "" {
+				v.SetCaptionTemplate("")
+				return "Caption template removed."
+			}
+			preview, err := previewCaptionTemplate(text, templateSite(v))
+			if err != nil {
+				return fmt.Sprintf("Invalid template, not saved. %s", err)
+			}
+			v.SetCaptionTemplate(text)
+			return "Caption template saved. Preview:\n\n" + previewOrEmpty(preview)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hPreviewTemplate(p []string, m *tb.Message) string {
+	if len(p) < 2 {
+		return "Usage: previewtemplate @channel_id/chat_id template"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			preview, err := previewCaptionTemplate(templateArg(m), templateSite(v))
+			if err != nil {
+				return fmt.Sprintf("Invalid template. %s", err)
+			}
+			return "Preview:\n\n" + previewOrEmpty(preview)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hGetTemplate(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: gettemplate @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			v.lock.RLock()
+			defer v.lock.RUnlock()
+			if v.CaptionTemplate == "" {
+				return "No caption template, captions of sites are used."
+			}
+			return v.CaptionTemplate
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hSetButtons(p []string, m *tb.Message) string {
+	usage := fmt.Sprintf("Usage: setbuttons @channel_id/chat_id %s/%s/%s", ButtonsAll, ButtonsSource, ButtonsNone)
+	if len(p) != 2 {
+		return usage
+	}
+	switch p[1] {
+	case ButtonsAll, ButtonsSource, ButtonsNone:
+	default:
+		return usage
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			v.SetButtons(p[1])
+			return "Buttons updated."
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hAddFilter(p []string, m *tb.Message) string {
+	if len(p) < 3 {
+		return fmt.Sprintf("Usage: addfilter @channel_id/chat_id all/site/site:userid kind [value]\n"+
+			"Sites: %s\nKinds: include/exclude keyword1,keyword2; regex/noregex expr; minmedia N; "+
+			"media; text; noretweet; noreply", strings.Join(MakeModuleLabeler().Names(), "/"))
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			rule, err := ParseFilterRule(p[1], p[2], strings.Join(p[3:], " "))
+			if err != nil {
+				return fmt.Sprintf("Invalid filter. %s", err)
+			}
+			v.AddFilter(rule)
+			return fmt.Sprintf("Filter added: %s", rule)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hDelFilter(p []string, m *tb.Message) string {
+	if len(p) != 2 {
+		return "Usage: delfilter @channel_id/chat_id N, N is the number in listfilter"
+	}
+	index, err := strconv.Atoi(p[1])
+	if err != nil {
+		return "Usage: delfilter @channel_id/chat_id N, N is the number in listfilter"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			rule, ok := v.DelFilter(index - 1)
+			if !ok {
+				return "No such filter."
+			}
+			return fmt.Sprintf("Filter deleted: %s", rule)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hListFilter(p []string, m *tb.Message) string {
+	if len(p) != 1 {
+		return "Usage: listfilter @channel_id/chat_id"
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			v.lock.RLock()
+			defer v.lock.RUnlock()
+			if v.Filters == nil || len(*v.Filters) == 0 {
+				return "No filters."
+			}
+			ret := make([]string, 0, len(*v.Filters)+1)
+			ret = append(ret, fmt.Sprintf("Filters for %s:", v.ID))
+			for i, rule := range *v.Filters {
+				ret = append(ret, fmt.Sprintf("%d. %s", i+1, rule))
+			}
+			return strings.Join(ret, "\n")
+		}
+	}
+	return "No such channel/chat"
+}
+
+// hTestFilter is a dry run of the filters over the newest items of a following
+func (t *TelegramBot) hTestFilter(p []string, m *tb.Message) string {
+	usage := "Usage: testfilter @channel_id/chat_id site userid [N]"
+	if len(p) < 3 {
+		return usage
+	}
+	// Search queries may contain spaces, a trailing number is the count
+	n, following := 10, strings.Join(p[2:], " ")
+	if len(p) > 3 {
+		if count, err := strconv.Atoi(p[len(p)-1]); err == nil {
+			if count <= 0 {
+				return usage
+			}
+			n, following = count, strings.Join(p[2:len(p)-1], " ")
+		}
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			moduleId := MakeModuleLabeler().Str2Module(p[1])
+			if moduleId < 0 {
+				return "Unsupported site."
+			}
+			messages, err := t.CreateModule(moduleId, v.ID).Latest(following, n)
+			if err != nil {
+				return fmt.Sprintf("Unable to fetch %s. %s", following, err)
+			}
+			if len(messages) == 0 {
+				return "No items."
+			}
+			ret := make([]string, 0, len(messages))
+			for _, msg := range messages {
+				summary := []rune(strings.Replace(msg.Caption, "\n", " ", -1))
+				if len(summary) > 60 {
+					summary = append(summary[:59], '…')
+				}
+				verdict := "PASS"
+				v.lock.RLock()
+				if rule := v.filterMessage(moduleId, msg); rule != nil {
+					verdict = fmt.Sprintf("DROP (%s)", rule)
+				}
+				v.lock.RUnlock()
+				ret = append(ret, fmt.Sprintf("%s %s, %d media: %s", verdict, msg.ID, len(msg.Resources), string(summary)))
+			}
+			return strings.Join(ret, "\n")
+		}
+	}
+	return "No such channel/chat"
+}
+
+func previewOrEmpty(preview string) string {
+	if preview == "" {
+		return "(empty caption, only media will be sent)"
+	}
+	return preview
+}
+
 func (t *TelegramBot) hGetId(p []string, m *tb.Message) string {
 	chatId := m.Chat.ID
 	chatTitle := m.Chat.Title
@@ -228,3 +617,64 @@ func authUser(user *tb.User, adminList []string, superAdminList []string) bool {
 	}
 	return false
 }
+
+func (t *TelegramBot) hSetSync(p []string, m *tb.Message) string {
+	usage := fmt.Sprintf("Usage: setsync @channel_id/chat_id hours(0-%d, 0 to disable)\n"+
+		"Posts sent in the last hours are deleted or edited when their sources are.", MaxSyncWindow/3600)
+	if len(p) != 2 {
+		return usage
+	}
+	hours, err := strconv.Atoi(p[1])
+	if err != nil || hours < 0 || hours*3600 > MaxSyncWindow {
+		return usage
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			v.SetSyncWindow(hours * 3600)
+			if hours == 0 {
+				return "Sync disabled."
+			}
+			return fmt.Sprintf("Posts of the last %d hour(s) will be kept in sync.", hours)
+		}
+	}
+	return "No such channel/chat"
+}
+
+func (t *TelegramBot) hSetOption(p []string, m *tb.Message) string {
+	if len(p) < 3 {
+		return "Usage: setoption @channel_id/chat_id site userid [option=value]\n" +
+			"Twitter: retweets=include/exclude/attribute replies=include/exclude/self\n" +
+			"Tumblr: types=all or text,quote,link,answer,video,audio,photo,chat"
+	}
+	following, key, value := strings.Join(p[2:], " "), "", ""
+	if last := p[len(p)-1]; len(p) > 3 && strings.Contains(last, "=") {
+		following = strings.Join(p[2:len(p)-1], " ")
+		split := strings.SplitN(last, "=", 2)
+		key, value = split[0], split[1]
+	}
+	for _, v := range *t.Channels {
+		if v.ID == p[0] {
+			if !authUser(m.Sender, *v.AdminUserIDs, t.Admins) {
+				return "Unauthorized."
+			}
+			module := MakeModuleLabeler().Str2Module(p[1])
+			if module == -1 {
+				return "Unsupported site."
+			}
+			found := false
+			v.lock.RLock()
+			for _, u := range (*v.Followings)[module] {
+				found = found || u == following
+			}
+			v.lock.RUnlock()
+			if !found {
+				return "No such following."
+			}
+			return t.CreateModule(module, v.ID).Configure(following, key, value)
+		}
+	}
+	return "No such channel/chat"
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	f "github.com/deamwork/tg_channel_bot/fetchers"
+	tb "github.com/ihciah/telebot"
+)
+
+// Telegram limits of files uploaded by bots
+const (
+	MaxPhotoUploadSize  = 10 << 20
+	MaxFileUploadSize   = 50 << 20
+	MaxThumbUploadSize  = 200 << 10
+	DefaultTempDirLimit = 512 // MB
+	TempDirWait         = time.Minute
+	uploadFilePrefix    = "upload-"
+)
+
+var errTempDirFull = errors.New("temp dir is full")
+
+// TempDir holds downloaded resources until they are uploaded, bounded in total size
+type TempDir struct {
+	Path  string
+	limit int64
+	used  int64
+	lock  sync.Mutex
+}
+
+func NewTempDir(dir string, limitMB int64) (*TempDir, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "tg_channel_bot")
+	}
+	if limitMB <= 0 {
+		limitMB = DefaultTempDirLimit
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Leftovers of a previous run
+	if leftovers, err := filepath.Glob(filepath.Join(dir, uploadFilePrefix+"*")); err == nil {
+		for _, p := range leftovers {
+			_ = os.Remove(p)
+		}
+	}
+	return &TempDir{Path: dir, limit: limitMB << 20}, nil
+}
+
+// acquire reserves n bytes, waiting a while for other uploads to finish
+func (d *TempDir) acquire(n int64) error {
+	deadline := time.Now().Add(TempDirWait)
+	for {
+		d.lock.Lock()
+		if d.used+n <= d.limit {
+			d.used += n
+			d.lock.Unlock()
+			return nil
+		}
+		d.lock.Unlock()
+		if n > d.limit || time.Now().After(deadline) {
+			return errTempDirFull
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (d *TempDir) release(n int64) {
+	d.lock.Lock()
+	d.used -= n
+	d.lock.Unlock()
+}
+
+func uploadLimit(r f.Resource) int64 {
+	if r.T == f.TIMAGE {
+		return MaxPhotoUploadSize
+	}
+	return MaxFileUploadSize
+}
+
+// canUpload tells whether a failed URL send is worth retrying by uploading the resources
+func canUpload(err error) bool {
+	if transient, _ := classifySendError(err); transient {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Bad Request") || strings.Contains(msg, "Request Entity Too Large")
+}
+
+func fromURL(r f.Resource) tb.File {
+	return tb.FromURL(r.URL)
+}
+
+// downloadResources fetches resources to the temp dir with the HTTP client of the module
+func (t *TelegramBot) downloadResources(moduleId int, chatId string, resources []f.Resource) (map[string]tb.File, func(), error) {
+	fetcher := t.CreateModule(moduleId, chatId)
+	files := make(map[string]tb.File, len(resources))
+	paths := make([]string, 0, len(resources))
+	var reserved int64
+	cleanup := func() {
+		for _, p := range paths {
+			_ = os.Remove(p)
+		}
+		t.Uploads.release(reserved)
+	}
+
+	for _, r := range resources {
+		if _, ok := files[r.URL]; ok {
+			continue
+		}
+		limit := uploadLimit(r)
+		if err := t.Uploads.acquire(limit); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		reserved += limit
+		file, err := ioutil.TempFile(t.Uploads.Path, uploadFilePrefix+"*"+path.Ext(strings.SplitN(r.URL, "?", 2)[0]))
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		paths = append(paths, file.Name())
+		size, err := fetcher.Download(r.URL, file, limit)
+		_ = file.Close()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		// Keep only the real size reserved
+		t.Uploads.release(limit - size)
+		reserved -= limit - size
+		files[r.URL] = tb.FromDisk(file.Name())
+
+		if r.T == f.TVIDEO && r.Thumbnail != "" {
+			// Videos are sent without thumbnail if it is unavailable
+			if err := t.Uploads.acquire(MaxThumbUploadSize); err != nil {
+				continue
+			}
+			reserved += MaxThumbUploadSize
+			thumbFile, err := ioutil.TempFile(t.Uploads.Path, uploadFilePrefix+"*.jpg")
+			if err != nil {
+				continue
+			}
+			paths = append(paths, thumbFile.Name())
+			size, err := fetcher.Download(r.Thumbnail, thumbFile, MaxThumbUploadSize)
+			_ = thumbFile.Close()
+			t.Uploads.release(MaxThumbUploadSize - size)
+			reserved -= MaxThumbUploadSize - size
+			if err != nil {
+				log.Println("Unable to download thumbnail", err)
+				continue
+			}
+			files[r.Thumbnail] = tb.FromDisk(thumbFile.Name())
+		}
+	}
+	return files, cleanup, nil
+}
+
+// Deliver sends a message fetched by the module from the part from, and returns the ids of
+// messages sent and the number of parts done. When Telegram is unable to fetch the resources
+// by URL, the ones not sent yet are downloaded by the bot and uploaded instead.
+func (t *TelegramBot) Deliver(to tb.Recipient, moduleId int, message f.ReplyMessage, keyboard *tb.ReplyMarkup, from int) ([]int, int, error) {
+	if message.Err != nil {
+		return nil, from, message.Err
+	}
+	sent, done, err := sendMessage(t, to, message, keyboard, fromURL, from)
+	if err == nil {
+		if len(message.Resources) != 0 {
+			log.Printf("Sent %d resource(s) via url to %s", len(message.Resources), to.Recipient())
+		}
+		return sent, done, nil
+	}
+	// Text parts are not worth uploading media for
+	plan := planAlbums(message.Resources)
+	if done >= len(plan) || !canUpload(err) {
+		return sent, done, err
+	}
+
+	log.Println("Unable to send via url, fallback to upload.", err)
+	var pending []f.Resource
+	for _, album := range plan[done:] {
+		pending = append(pending, album...)
+	}
+	files, cleanup, dErr := t.downloadResources(moduleId, to.Recipient(), pending)
+	if dErr != nil {
+		log.Println("Unable to download resources", dErr)
+		return sent, done, err
+	}
+	defer cleanup()
+	more, done, err := sendMessage(t, to, message, keyboard, func(r f.Resource) tb.File {
+		return files[r.URL]
+	}, done)
+	if err == nil {
+		log.Printf("Sent %d resource(s) via upload to %s", len(pending), to.Recipient())
+	}
+	return append(sent, more...), done, err
+}